@@ -0,0 +1,174 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+// Atomic check-then-act operations. Every one of these holds the cache lock
+// for its entire duration, so nothing can happen to the element in between the
+// check and the act. None of them call OnMiss.
+
+// ComputeOp tells Compute what to do with the element.
+type ComputeOp int
+
+const (
+	// Leave the element as it is (or absent)
+	ComputeKeep ComputeOp = iota
+	// Store the returned value, replacing the existing element if any
+	ComputeStore
+	// Delete the element, if any
+	ComputeDelete
+)
+
+// liveEntry returns the entry for this id, unless there is none, it is a
+// remembered miss, or it is obsolete (in which case it is purged)
+func liveEntry(c *Cache, id string) *cacheEntry {
+	e, ok := c.entries[id]
+	if !ok || e.err != nil {
+		return nil
+	}
+	if why, dead := obsolete(c, e); dead {
+		purgeEntry(c, e, why)
+		return nil
+	}
+	return e
+}
+
+// Default for the equality functions below
+func equals(a, b Cacheable) bool {
+	return a == b
+}
+
+// GetOrSet returns the element stored under id, if any, and marks it as used.
+// Otherwise, it stores p, exactly like Set, and returns it. The boolean reports
+// whether the element was already there.
+func (c *Cache) GetOrSet(id string, p Cacheable) (actual Cacheable, loaded bool) {
+	if p == nil {
+		panic("Cacheable value must not be nil")
+	}
+	c.lock.Lock()
+	defer c.unlock()
+	if e := liveEntry(c, id); e != nil {
+		touchEntry(c, e)
+		return handOut(c, e.payload), true
+	}
+	if directSet(c, id, p, inheritTTL) == ErrTooLarge {
+		notePanic(c, rejectEntry(c, id, p))
+	}
+	return handOut(c, p), false
+}
+
+// Swap stores p under id, exactly like Set, and returns the element it
+// replaced, if any. The replaced element is purged with reason KEYCOLLISION.
+//
+// If p is too large to ever fit in the cache, it is rejected as by Set, and
+// the element stored under id, if any, stays cached. It is still returned,
+// with loaded true, as it would have been had p been stored.
+func (c *Cache) Swap(id string, p Cacheable) (previous Cacheable, loaded bool) {
+	if p == nil {
+		panic("Cacheable value must not be nil")
+	}
+	c.lock.Lock()
+	defer c.unlock()
+	if e := liveEntry(c, id); e != nil {
+		previous, loaded = handOut(c, e.payload), true
+	}
+	if directSet(c, id, p, inheritTTL) == ErrTooLarge {
+		notePanic(c, rejectEntry(c, id, p))
+	}
+	return previous, loaded
+}
+
+// CompareAndSwap stores new under id, exactly like Set, but only if the element
+// currently stored there is equal to old. Reports whether it did. The replaced
+// element is purged with reason KEYCOLLISION. If new is too large to ever fit
+// in the cache, it is rejected as by Set, the old element stays cached, and
+// CompareAndSwap returns false.
+//
+// If equal is nil, elements are compared with ==, which panics if they are not
+// comparable. With Config.CloneOnGet, the cached element is a copy, so pointers
+// never compare equal: pass an equal which compares by value instead.
+func (c *Cache) CompareAndSwap(id string, old, new Cacheable, equal func(a, b Cacheable) bool) bool {
+	if new == nil {
+		panic("Cacheable value must not be nil")
+	}
+	if equal == nil {
+		equal = equals
+	}
+	c.lock.Lock()
+	defer c.unlock()
+	e := liveEntry(c, id)
+	if e == nil || !equal(handOut(c, e.payload), old) {
+		return false
+	}
+	if directSet(c, id, new, inheritTTL) == ErrTooLarge {
+		notePanic(c, rejectEntry(c, id, new))
+		return false
+	}
+	return true
+}
+
+// CompareAndDelete deletes the element stored under id, but only if it is equal
+// to old. Reports whether it did. The element is purged with reason
+// EXPLICITDELETE.
+//
+// If equal is nil, elements are compared with ==, which panics if they are not
+// comparable.
+func (c *Cache) CompareAndDelete(id string, old Cacheable, equal func(a, b Cacheable) bool) bool {
+	if equal == nil {
+		equal = equals
+	}
+	c.lock.Lock()
+	defer c.unlock()
+	e := liveEntry(c, id)
+	if e == nil || !equal(handOut(c, e.payload), old) {
+		return false
+	}
+	invalidateLoad(c, id)
+	purgeEntry(c, e, EXPLICITDELETE)
+	return true
+}
+
+// Compute decides what to do with the element stored under id, based on its
+// current value. f is called with that value, and whether there is one, and
+// returns a new value along with what to do with it. Returns the element
+// stored under id afterwards, if any.
+//
+// Storing is exactly like Set; a replaced element is purged with reason
+// KEYCOLLISION. Deleting purges with reason EXPLICITDELETE.
+//
+// f is called with the cache locked. It must not use the cache itself, and
+// should be quick.
+func (c *Cache) Compute(id string, f func(old Cacheable, found bool) (Cacheable, ComputeOp)) (Cacheable, bool) {
+	c.lock.Lock()
+	defer c.unlock()
+	e := liveEntry(c, id)
+	var old Cacheable
+	if e != nil {
+		old = handOut(c, e.payload)
+	}
+	p, op := f(old, e != nil)
+	switch op {
+	case ComputeStore:
+		if p == nil {
+			panic("Cacheable value must not be nil")
+		}
+		if directSet(c, id, p, inheritTTL) == ErrTooLarge {
+			notePanic(c, rejectEntry(c, id, p))
+			break
+		}
+		return handOut(c, p), true
+	case ComputeDelete:
+		invalidateLoad(c, id)
+		if e != nil {
+			purgeEntry(c, e, EXPLICITDELETE)
+		}
+		return nil, false
+	}
+	// Kept, or failed to store
+	if e = liveEntry(c, id); e != nil {
+		touchEntry(c, e)
+		return handOut(c, e.payload), true
+	}
+	return nil, false
+}
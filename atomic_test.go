@@ -0,0 +1,176 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestGetOrSet(t *testing.T) {
+	c := New(10)
+	defer c.Close()
+	if v, loaded := c.GetOrSet("a", 1); v != 1 || loaded {
+		t.Error("Unexpected result storing new element:", v, loaded)
+	}
+	if v, loaded := c.GetOrSet("a", 2); v != 1 || !loaded {
+		t.Error("Unexpected result for existing element:", v, loaded)
+	}
+	// Concurrent callers all agree on the winner
+	var wg sync.WaitGroup
+	results := make([]Cacheable, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.GetOrSet("b", i)
+		}(i)
+	}
+	wg.Wait()
+	for _, r := range results {
+		if r != results[0] {
+			t.Fatal("GetOrSet callers disagree:", results)
+		}
+	}
+
+	checkDLL(t, c)
+}
+
+func TestSwap(t *testing.T) {
+	c := New(10)
+	defer c.Close()
+	var x purgeable
+	if _, loaded := c.Swap("x", &x); loaded {
+		t.Error("Swap reported previous element for new key")
+	}
+	prev, loaded := c.Swap("x", 2)
+	if prev != &x || !loaded {
+		t.Error("Unexpected previous element:", prev, loaded)
+	}
+	if !x.purged || x.why != KEYCOLLISION {
+		t.Error("Swapped element not purged with KEYCOLLISION")
+	}
+
+	checkDLL(t, c)
+}
+
+func TestCompareAndSwapDelete(t *testing.T) {
+	c := New(10)
+	defer c.Close()
+	c.Set("a", 1)
+	if c.CompareAndSwap("a", 2, 3, nil) {
+		t.Error("Swapped despite mismatch")
+	}
+	if !c.CompareAndSwap("a", 1, 3, nil) {
+		t.Error("Did not swap despite match")
+	}
+	if v, _ := c.Get("a"); v != 3 {
+		t.Error("Unexpected value after CompareAndSwap:", v)
+	}
+	if c.CompareAndSwap("missing", nil, 1, nil) {
+		t.Error("Swapped missing element")
+	}
+	sameParity := func(a, b Cacheable) bool {
+		return a.(int)%2 == b.(int)%2
+	}
+	if c.CompareAndDelete("a", 2, sameParity) {
+		t.Error("Deleted despite mismatch")
+	}
+	var x purgeable
+	c.Set("x", &x)
+	if !c.CompareAndDelete("x", &x, nil) {
+		t.Error("Did not delete despite match")
+	}
+	if !x.purged || x.why != EXPLICITDELETE {
+		t.Error("Deleted element not purged with EXPLICITDELETE")
+	}
+	if !c.CompareAndDelete("a", 5, sameParity) {
+		t.Error("Did not delete despite custom match")
+	}
+	if c.Size() != 0 {
+		t.Error("Unexpected size:", c.Size())
+	}
+
+	checkDLL(t, c)
+}
+
+func TestAtomicTooLarge(t *testing.T) {
+	c := New(10)
+	defer c.Close()
+	var big1, big2 bigpurgeable
+	c.Set("a", 1)
+	prev, loaded := c.Swap("a", &big1)
+	if prev != 1 || !loaded {
+		t.Error("Unexpected previous element:", prev, loaded)
+	}
+	if !big1.purged || big1.why != CACHEFULL {
+		t.Error("Oversized element not purged with CACHEFULL by Swap")
+	}
+	if v, _ := c.Get("a"); v != 1 {
+		t.Error("Previous element not kept after rejected Swap:", v)
+	}
+	if c.CompareAndSwap("a", 1, &big2, nil) {
+		t.Error("CompareAndSwap reported storing oversized element")
+	}
+	if !big2.purged || big2.why != CACHEFULL {
+		t.Error("Oversized element not purged with CACHEFULL by CompareAndSwap")
+	}
+	if v, _ := c.Get("a"); v != 1 {
+		t.Error("Old element not kept after rejected CompareAndSwap:", v)
+	}
+
+	checkDLL(t, c)
+}
+
+func TestCompute(t *testing.T) {
+	c := New(10)
+	defer c.Close()
+	appendOp := func(old Cacheable, found bool) (Cacheable, ComputeOp) {
+		if !found {
+			return "x", ComputeStore
+		}
+		return old.(string) + "x", ComputeStore
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Compute("a", appendOp)
+		}()
+	}
+	wg.Wait()
+	if v, _ := c.Get("a"); v != "xxxxxxxxxx" {
+		t.Error("Lost updates in Compute:", v)
+	}
+	v, ok := c.Compute("a", func(old Cacheable, found bool) (Cacheable, ComputeOp) {
+		return nil, ComputeKeep
+	})
+	if v != "xxxxxxxxxx" || !ok {
+		t.Error("Unexpected result from ComputeKeep:", v, ok)
+	}
+	var x purgeable
+	c.Set("x", &x)
+	v, ok = c.Compute("x", func(old Cacheable, found bool) (Cacheable, ComputeOp) {
+		return nil, ComputeDelete
+	})
+	if v != nil || ok || x.why != EXPLICITDELETE {
+		t.Error("Unexpected result from ComputeDelete:", v, ok, x)
+	}
+	for i := 0; i < 3; i++ {
+		c.Compute(strconv.Itoa(i), func(old Cacheable, found bool) (Cacheable, ComputeOp) {
+			if found {
+				t.Error("Found element which was never stored")
+			}
+			return nil, ComputeKeep
+		})
+	}
+	if c.Size() != 1 {
+		t.Error("Unexpected size:", c.Size())
+	}
+
+	checkDLL(t, c)
+}
@@ -0,0 +1,128 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerOptions configures a CircuitBreaker. The zero value is a sane
+// default.
+type CircuitBreakerOptions struct {
+	// Number of consecutive failures after which the circuit opens. Defaults
+	// to 5.
+	Threshold int
+	// How long the circuit stays open before a single call is let through to
+	// probe for recovery. Defaults to 10 seconds.
+	OpenTimeout time.Duration
+	// Decides whether an error counts as a failure. By default, every error
+	// does. A (nil, nil) "not found" result is never a failure.
+	IsFailure func(error) bool
+	// Source of time, nil for the system clock
+	Clock Clock
+}
+
+// CircuitOpenError is returned by a CircuitBreaker wrapper, without calling
+// the wrapped function, while the circuit is open.
+type CircuitOpenError struct {
+	// When the next call will be let through
+	Until time.Time
+	// The failure which opened the circuit
+	Cause error
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit open until %v after: %v", e.Until, e.Cause)
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	// A single probing call is in progress
+	circuitHalfOpen
+)
+
+type circuitBreaker struct {
+	lock     sync.Mutex
+	opts     CircuitBreakerOptions
+	state    circuitState
+	failures int
+	until    time.Time
+	cause    error
+}
+
+// enter reports whether a call may go through, or the error to fail with
+func (cb *circuitBreaker) enter() error {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if cb.opts.Clock.Now().Before(cb.until) {
+			break
+		}
+		// This caller gets to probe
+		cb.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		break
+	default:
+		return nil
+	}
+	return &CircuitOpenError{Until: cb.until, Cause: cb.cause}
+}
+
+// leave records the outcome of a call let through by enter
+func (cb *circuitBreaker) leave(err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if err == nil || !cb.opts.IsFailure(err) {
+		cb.state = circuitClosed
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.opts.Threshold {
+		cb.state = circuitOpen
+		cb.until = cb.opts.Clock.Now().Add(cb.opts.OpenTimeout)
+		cb.cause = err
+	}
+}
+
+// Wrapper function that stops calling f after a number of consecutive
+// failures. Intended for wrapping OnMiss handlers, to stop hammering a backend
+// which is down.
+//
+// Once the threshold is reached, the circuit "opens": calls fail immediately
+// with a *CircuitOpenError, until the open timeout passes. Then a single call
+// is let through. If it succeeds the circuit closes again, otherwise it stays
+// open for another timeout. A panic in f counts as a failure, and is returned
+// as a *PanicError.
+func CircuitBreaker(f OnMissHandler, opts CircuitBreakerOptions) OnMissHandler {
+	if opts.Threshold <= 0 {
+		opts.Threshold = 5
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 10 * time.Second
+	}
+	if opts.IsFailure == nil {
+		opts.IsFailure = func(error) bool { return true }
+	}
+	if opts.Clock == nil {
+		opts.Clock = realClock{}
+	}
+	cb := &circuitBreaker{opts: opts}
+	return func(key string) (Cacheable, error) {
+		if err := cb.enter(); err != nil {
+			return nil, err
+		}
+		val, err := protect(func() (Cacheable, error) { return f(key) })
+		cb.leave(err)
+		return val, err
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	myerr := errors.New("backend down")
+	var fail bool
+	calls := 0
+	f := CircuitBreaker(func(id string) (Cacheable, error) {
+		calls++
+		if fail {
+			return nil, myerr
+		}
+		return id, nil
+	}, CircuitBreakerOptions{Threshold: 3, OpenTimeout: time.Minute, Clock: clock})
+	fail = true
+	for i := 0; i < 3; i++ {
+		if _, err := f("foo"); err != myerr {
+			t.Fatal("Expected error from wrapped function, got:", err)
+		}
+	}
+	_, err := f("foo")
+	open, ok := err.(*CircuitOpenError)
+	if !ok {
+		t.Fatal("Expected *CircuitOpenError, got:", err)
+	}
+	if open.Cause != myerr || !open.Until.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf("Unexpected error details: %+v", open)
+	}
+	if calls != 3 {
+		t.Error("Wrapped function called while circuit open:", calls)
+	}
+	// Failed probe opens the circuit again
+	clock.Advance(time.Minute)
+	if _, err := f("foo"); err != myerr {
+		t.Error("Expected probe to call wrapped function, got:", err)
+	}
+	if _, err := f("foo"); err == nil || err == myerr {
+		t.Error("Expected circuit to open after failed probe, got:", err)
+	}
+	// Successful probe closes it
+	clock.Advance(time.Minute)
+	fail = false
+	for i := 0; i < 3; i++ {
+		if _, err := f("foo"); err != nil {
+			t.Error("Unexpected error after recovery:", err)
+		}
+	}
+	if calls != 7 {
+		t.Error("Unexpected number of calls:", calls)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	probing := make(chan bool)
+	release := make(chan bool)
+	fail := true
+	f := CircuitBreaker(func(id string) (Cacheable, error) {
+		if fail {
+			return nil, errors.New("fail")
+		}
+		if id == "probe" {
+			probing <- true
+			<-release
+		}
+		return id, nil
+	}, CircuitBreakerOptions{Threshold: 1, Clock: clock})
+	f("foo")
+	clock.Advance(10 * time.Second)
+	fail = false
+	done := make(chan bool)
+	go func() {
+		f("probe")
+		done <- true
+	}()
+	<-probing
+	// Only one probe at a time
+	if _, err := f("foo"); err == nil {
+		t.Error("Second call let through while probing")
+	}
+	close(release)
+	<-done
+	if _, err := f("foo"); err != nil {
+		t.Error("Circuit not closed after successful probe:", err)
+	}
+}
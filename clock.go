@@ -0,0 +1,32 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"time"
+)
+
+// Clock is the source of time for a cache and its wrappers. All decisions
+// based on time go through it: expiry, backoff, timeouts, etc. The default is
+// the system clock; overriding it is mostly useful for testing. See the
+// lrucachetest package for a fake clock.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once duration d has passed. The
+	// returned function cancels the call, and reports whether it did so before
+	// f was called. See time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
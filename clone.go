@@ -0,0 +1,162 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"log"
+	"math"
+	"reflect"
+)
+
+// cloneValue copies a value through its Cloner, or else Config.Clone. Values
+// with neither are returned as they are.
+func cloneValue(c *Cache, p Cacheable) Cacheable {
+	if x, ok := p.(Cloner); ok {
+		return x.Clone()
+	}
+	if c.clone != nil {
+		return c.clone(p)
+	}
+	return p
+}
+
+// handOut returns a copy of a cached value to give to the user, if
+// Config.CloneOnGet is set
+func handOut(c *Cache, p Cacheable) Cacheable {
+	if p != nil && c.cloneOnGet {
+		return cloneValue(c, p)
+	}
+	return p
+}
+
+// rememberHash hashes the payload of an entry as it is stored, if mutation
+// detection is on
+func rememberHash(c *Cache, e *cacheEntry) {
+	if c.detectMutation {
+		e.hash = deepHash(e.payload)
+	}
+	return
+}
+
+// checkMutation reports an entry whose payload changed since it was stored, if
+// mutation detection is on
+func checkMutation(c *Cache, e *cacheEntry) {
+	if !c.detectMutation || deepHash(e.payload) == e.hash {
+		return
+	}
+	if c.onMutation == nil {
+		log.Printf("lrucache: element %q was modified while cached", e.id)
+		return
+	}
+	notePanic(c, catchPanic(func() { c.onMutation(e.id, e.payload) }))
+	return
+}
+
+// deepHash hashes everything reachable from x, following pointers, but not
+// functions or channels. Maps are hashed regardless of their iteration order.
+func deepHash(x interface{}) uint64 {
+	h := hasher{h: fnv.New64a(), path: map[uintptr]bool{}}
+	h.value(reflect.ValueOf(x))
+	return h.h.Sum64()
+}
+
+type hasher struct {
+	h   hash.Hash64
+	buf [8]byte
+	// Pointers being hashed, to break cycles
+	path map[uintptr]bool
+}
+
+func (h *hasher) uint(x uint64) {
+	binary.LittleEndian.PutUint64(h.buf[:], x)
+	h.h.Write(h.buf[:])
+}
+
+// enter reports whether a pointer is not already being hashed, and marks it
+// as such
+func (h *hasher) enter(p uintptr) bool {
+	if h.path[p] {
+		h.uint(uint64(p))
+		return false
+	}
+	h.path[p] = true
+	return true
+}
+
+func (h *hasher) value(v reflect.Value) {
+	if !v.IsValid() {
+		h.uint(0)
+		return
+	}
+	h.uint(uint64(v.Kind()))
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			h.uint(1)
+		} else {
+			h.uint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		h.uint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		h.uint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		h.uint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		h.uint(math.Float64bits(real(v.Complex())))
+		h.uint(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		h.uint(uint64(v.Len()))
+		h.h.Write([]byte(v.String()))
+	case reflect.Ptr:
+		if v.IsNil() {
+			h.uint(0)
+			return
+		}
+		p := v.Pointer()
+		if h.enter(p) {
+			h.value(v.Elem())
+			delete(h.path, p)
+		}
+	case reflect.Interface:
+		h.value(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			h.value(v.Field(i))
+		}
+	case reflect.Array, reflect.Slice:
+		h.uint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			h.value(v.Index(i))
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			h.uint(0)
+			return
+		}
+		p := v.Pointer()
+		if !h.enter(p) {
+			return
+		}
+		// Order independent: sum the hashes of the separate entries
+		var sum uint64
+		iter := v.MapRange()
+		for iter.Next() {
+			entry := hasher{h: fnv.New64a(), path: h.path}
+			entry.value(iter.Key())
+			entry.value(iter.Value())
+			sum += entry.h.Sum64()
+		}
+		delete(h.path, p)
+		h.uint(uint64(v.Len()))
+		h.uint(sum)
+	default:
+		// Functions, channels and unsafe pointers: only their identity
+		h.uint(uint64(v.Pointer()))
+	}
+}
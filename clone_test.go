@@ -0,0 +1,139 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"testing"
+)
+
+type headers map[string]string
+
+func (h headers) Clone() Cacheable {
+	c := headers{}
+	for k, v := range h {
+		c[k] = v
+	}
+	return c
+}
+
+func TestCloneOnSet(t *testing.T) {
+	c, err := NewWithOptions(WithCloneOnSet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := headers{"a": "1"}
+	c.Set("h", h)
+	h["a"] = "2"
+	if v, _ := c.Get("h"); v.(headers)["a"] != "1" {
+		t.Error("Changing the original changed the cached value")
+	}
+	// Without CloneOnGet, the result is the cached value itself
+	v, _ := c.Get("h")
+	v.(headers)["a"] = "3"
+	if v, _ := c.Get("h"); v.(headers)["a"] != "3" {
+		t.Error("Unexpected copy on Get")
+	}
+}
+
+func TestCloneOnGet(t *testing.T) {
+	type point struct{ x, y int }
+	c, err := NewWithOptions(WithCloneOnGet(), WithClone(func(p Cacheable) Cacheable {
+		cp := *p.(*point)
+		return &cp
+	}), WithOnMiss(func(id string) (Cacheable, error) {
+		return &point{1, 2}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := c.Get("p")
+	v.(*point).x = 10
+	w, _ := c.Get("p")
+	if w.(*point).x != 1 {
+		t.Error("Changing the result of a miss changed the cached value")
+	}
+	w.(*point).x = 10
+	if v, _ := c.Get("p"); v.(*point).x != 1 {
+		t.Error("Changing the result of a hit changed the cached value")
+	}
+}
+
+func TestDetectMutation(t *testing.T) {
+	mutated := map[string]bool{}
+	c, err := NewWithOptions(WithMutationDetection(func(id string, p Cacheable) {
+		mutated[id] = true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type node struct {
+		next *node
+		tags map[string][]int
+	}
+	cyclic := &node{tags: map[string][]int{"x": {1}, "y": {2}}}
+	cyclic.next = cyclic
+	c.Set("cyclic", cyclic)
+	c.Set("untouched", &node{tags: map[string][]int{"a": {1}, "b": {2}, "c": {3}}})
+	m := headers{"a": "1"}
+	c.Set("map", m)
+	cyclic.tags["y"][0] = 3
+	m["b"] = "2"
+	c.Delete("cyclic")
+	c.Delete("untouched")
+	c.Delete("map")
+	if !mutated["cyclic"] || !mutated["map"] || mutated["untouched"] {
+		t.Error("Unexpected mutations detected:", mutated)
+	}
+	c.Set("counter", 1)
+	if err := c.Update("counter", 2); err != nil {
+		t.Fatal(err)
+	}
+	c.Delete("counter")
+	if mutated["counter"] {
+		t.Error("Update counted as mutation")
+	}
+}
+
+func TestCloneOnGetAtomic(t *testing.T) {
+	c, err := NewWithOptions(WithCloneOnGet())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameA := func(a, b Cacheable) bool { return a.(headers)["a"] == b.(headers)["a"] }
+	check := func(what string, h Cacheable) {
+		h.(headers)["a"] = "changed"
+		if v, _ := c.Get("h"); v.(headers)["a"] == "changed" {
+			t.Error(what, "handed out the cached value")
+		}
+	}
+	v, _ := c.GetOrSet("h", headers{"a": "1"})
+	check("GetOrSet (set)", v)
+	v, _ = c.GetOrSet("h", headers{"a": "2"})
+	check("GetOrSet (get)", v)
+	v, _ = c.Swap("h", headers{"a": "3"})
+	if v.(headers)["a"] != "1" {
+		t.Error("Unexpected previous value:", v)
+	}
+	// Callbacks run with the cache locked: check afterwards
+	var arg Cacheable
+	v, _ = c.Compute("h", func(old Cacheable, found bool) (Cacheable, ComputeOp) {
+		arg = old
+		return nil, ComputeKeep
+	})
+	check("Compute (argument)", arg)
+	check("Compute (keep)", v)
+	v, _ = c.Compute("h", func(old Cacheable, found bool) (Cacheable, ComputeOp) {
+		return headers{"a": "4"}, ComputeStore
+	})
+	check("Compute (store)", v)
+	c.CompareAndSwap("h", headers{"a": "4"}, headers{"a": "5"}, func(a, b Cacheable) bool {
+		arg = a
+		return false
+	})
+	check("CompareAndSwap", arg)
+	if !c.CompareAndSwap("h", headers{"a": "4"}, headers{"a": "5"}, sameA) {
+		t.Error("CompareAndSwap by value failed")
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"fmt"
+	"time"
+)
+
+// EvictionPolicy determines which element is purged first from a full cache.
+type EvictionPolicy int
+
+const (
+	// Purge the least recently used element. This is the default.
+	LRU EvictionPolicy = iota
+	// Purge the least recently stored element, regardless of how often it has
+	// been requested since.
+	FIFO
+)
+
+// Config holds all settings of a cache, for use with NewWithConfig. The zero
+// value is a valid configuration for a cache without any limits.
+type Config struct {
+	// See Cache.MaxSize
+	MaxSize int64
+	// See Cache.MaxEntries
+	MaxEntries int64
+	// See Cache.MaxEntrySize
+	MaxEntrySize int64
+	// See Cache.MaxEntryFraction
+	MaxEntryFraction float64
+	// Time to live of elements stored through Set or OnMiss. See
+	// Cache.SetWithTTL. Leave at 0 for elements which never expire.
+	DefaultTTL time.Duration
+	// Idle timeout of elements stored through Set or OnMiss. See
+	// Cache.SetWithIdleTimeout. Leave at 0 for elements which never expire
+	// for lack of use.
+	DefaultIdleTimeout time.Duration
+	// See Cache.OnMiss
+	OnMiss OnMissHandler
+	// Call OnMiss for every Get of a missing id, even if a call for that id is
+	// already in progress. By default, concurrent Gets for the same id share
+	// the result of a single call.
+	ConcurrentMisses bool
+	// Which element to purge first from a full cache, LRU by default
+	EvictionPolicy EvictionPolicy
+	// Source of time, nil for the system clock
+	Clock Clock
+	// Remember for this long that OnMiss could not find an id, i.e. returned
+	// (nil, nil). Subsequent Gets for that id return ErrNotFound without
+	// calling OnMiss again, until this expires or a value is Set for the id.
+	// Leave at 0 to always call OnMiss.
+	NegativeTTL time.Duration
+	// Like NegativeTTL, but for errors returned by OnMiss. Subsequent Gets
+	// return the same error (without a value).
+	ErrorTTL time.Duration
+	// The size of a remembered miss or error, see Cache.MaxSize. Defaults to
+	// 1.
+	NegativeSize int64
+	// Reload elements in the background through OnMiss, once this fraction of
+	// their time to live has passed and they are requested. Popular elements
+	// are thereby refreshed before they expire, and never cause a cache miss.
+	// E.g. with 0.8, an element with a TTL of 10 minutes is refreshed the first
+	// time it is requested after 8 minutes. Only applies to elements which
+	// expire. Leave at 0 to disable.
+	RefreshAhead float64
+	// Maximum number of refreshes in progress at any time. Refreshes which
+	// would exceed this are skipped, to be tried again on the next request.
+	// Defaults to 1.
+	RefreshWorkers int
+	// Called, from a background goroutine, when refreshing an element fails.
+	// The old element is kept until it expires. Not finding an element counts
+	// as failure (ErrNotFound).
+	OnRefreshError func(id string, err error)
+	// Called for every purged element, in order
+	Listeners []PurgeListener
+	// Keep usage statistics, see Cache.Stats
+	Stats bool
+	// Makes a deep copy of a value which doesn't implement Cloner, for
+	// CloneOnSet and CloneOnGet. Values which are neither are never copied.
+	Clone func(Cacheable) Cacheable
+	// Store a copy of every value passed to Set (or one of its variants) or
+	// Update, or returned by OnMiss. Changing the original afterwards does not
+	// change the cached value.
+	CloneOnSet bool
+	// Return a copy of the cached value from every Get, and from the other
+	// methods which hand out cached values: GetOrSet, Swap and Compute, as
+	// well as the comparison and compute functions passed to CompareAndSwap,
+	// CompareAndDelete and Compute. Changing the result does not change the
+	// cached value.
+	CloneOnGet bool
+	// Debugging aid: detect cached values which are changed in place. Every
+	// value is hashed, deeply, when it is stored, and again when it leaves
+	// the cache. If the hashes differ, OnMutation is called. This is slow;
+	// don't enable it in production.
+	DetectMutation bool
+	// Called with the id and value of every element found to have changed
+	// while cached, see DetectMutation. Called with the cache locked, under
+	// the same conditions as a PurgeListener. Defaults to logging it through
+	// the standard logger.
+	OnMutation func(id string, p Cacheable)
+}
+
+// validate returns a descriptive error for the first invalid setting, if any
+func (cfg Config) validate() error {
+	switch {
+	case cfg.MaxSize < 0:
+		return fmt.Errorf("MaxSize must not be negative: %d", cfg.MaxSize)
+	case cfg.MaxEntries < 0:
+		return fmt.Errorf("MaxEntries must not be negative: %d", cfg.MaxEntries)
+	case cfg.MaxEntrySize < 0:
+		return fmt.Errorf("MaxEntrySize must not be negative: %d", cfg.MaxEntrySize)
+	case cfg.MaxSize > 0 && cfg.MaxEntrySize > cfg.MaxSize:
+		return fmt.Errorf("MaxEntrySize (%d) exceeds MaxSize (%d)", cfg.MaxEntrySize, cfg.MaxSize)
+	case !(cfg.MaxEntryFraction >= 0 && cfg.MaxEntryFraction <= 1):
+		return fmt.Errorf("MaxEntryFraction must be in [0, 1]: %v", cfg.MaxEntryFraction)
+	case cfg.DefaultTTL < 0:
+		return fmt.Errorf("DefaultTTL must not be negative: %v", cfg.DefaultTTL)
+	case cfg.DefaultIdleTimeout < 0:
+		return fmt.Errorf("DefaultIdleTimeout must not be negative: %v", cfg.DefaultIdleTimeout)
+	case cfg.NegativeTTL < 0:
+		return fmt.Errorf("NegativeTTL must not be negative: %v", cfg.NegativeTTL)
+	case cfg.ErrorTTL < 0:
+		return fmt.Errorf("ErrorTTL must not be negative: %v", cfg.ErrorTTL)
+	case cfg.NegativeSize < 0:
+		return fmt.Errorf("NegativeSize must not be negative: %d", cfg.NegativeSize)
+	case cfg.RefreshAhead < 0 || cfg.RefreshAhead >= 1:
+		return fmt.Errorf("RefreshAhead must be in [0, 1): %v", cfg.RefreshAhead)
+	case cfg.RefreshWorkers < 0:
+		return fmt.Errorf("RefreshWorkers must not be negative: %d", cfg.RefreshWorkers)
+	case cfg.EvictionPolicy != LRU && cfg.EvictionPolicy != FIFO:
+		return fmt.Errorf("Unknown EvictionPolicy: %d", cfg.EvictionPolicy)
+	}
+	for i, l := range cfg.Listeners {
+		if l == nil {
+			return fmt.Errorf("Listener %d is nil", i)
+		}
+	}
+	return nil
+}
+
+// NewWithConfig creates and initializes a new cache, ready for use. Returns an
+// error if the configuration is invalid.
+func NewWithConfig(cfg Config) (*Cache, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	// Don't share the backing array with the caller
+	cfg.Listeners = append([]PurgeListener(nil), cfg.Listeners...)
+	var c Cache
+	c.init(cfg)
+	return &c, nil
+}
+
+// Option is a single setting for NewWithOptions.
+type Option func(*Config)
+
+// NewWithOptions creates and initializes a new cache from a list of options.
+// Returns an error if the resulting configuration is invalid. E.g.:
+//
+//	c, err := lrucache.NewWithOptions(
+//	    lrucache.WithMaxSize(1000),
+//	    lrucache.WithDefaultTTL(time.Minute),
+//	)
+func NewWithOptions(opts ...Option) (*Cache, error) {
+	var cfg Config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return NewWithConfig(cfg)
+}
+
+// WithMaxSize sets Config.MaxSize.
+func WithMaxSize(n int64) Option {
+	return func(cfg *Config) { cfg.MaxSize = n }
+}
+
+// WithMaxEntries sets Config.MaxEntries.
+func WithMaxEntries(n int64) Option {
+	return func(cfg *Config) { cfg.MaxEntries = n }
+}
+
+// WithMaxEntrySize sets Config.MaxEntrySize.
+func WithMaxEntrySize(n int64) Option {
+	return func(cfg *Config) { cfg.MaxEntrySize = n }
+}
+
+// WithMaxEntryFraction sets Config.MaxEntryFraction.
+func WithMaxEntryFraction(f float64) Option {
+	return func(cfg *Config) { cfg.MaxEntryFraction = f }
+}
+
+// WithDefaultTTL sets Config.DefaultTTL.
+func WithDefaultTTL(d time.Duration) Option {
+	return func(cfg *Config) { cfg.DefaultTTL = d }
+}
+
+// WithDefaultIdleTimeout sets Config.DefaultIdleTimeout.
+func WithDefaultIdleTimeout(d time.Duration) Option {
+	return func(cfg *Config) { cfg.DefaultIdleTimeout = d }
+}
+
+// WithOnMiss sets Config.OnMiss.
+func WithOnMiss(f OnMissHandler) Option {
+	return func(cfg *Config) { cfg.OnMiss = f }
+}
+
+// WithConcurrentMisses sets Config.ConcurrentMisses.
+func WithConcurrentMisses() Option {
+	return func(cfg *Config) { cfg.ConcurrentMisses = true }
+}
+
+// WithEvictionPolicy sets Config.EvictionPolicy.
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(cfg *Config) { cfg.EvictionPolicy = p }
+}
+
+// WithClock sets Config.Clock.
+func WithClock(clock Clock) Option {
+	return func(cfg *Config) { cfg.Clock = clock }
+}
+
+// WithNegativeTTL sets Config.NegativeTTL.
+func WithNegativeTTL(d time.Duration) Option {
+	return func(cfg *Config) { cfg.NegativeTTL = d }
+}
+
+// WithErrorTTL sets Config.ErrorTTL.
+func WithErrorTTL(d time.Duration) Option {
+	return func(cfg *Config) { cfg.ErrorTTL = d }
+}
+
+// WithNegativeSize sets Config.NegativeSize.
+func WithNegativeSize(n int64) Option {
+	return func(cfg *Config) { cfg.NegativeSize = n }
+}
+
+// WithRefreshAhead sets Config.RefreshAhead and Config.RefreshWorkers.
+func WithRefreshAhead(fraction float64, workers int) Option {
+	return func(cfg *Config) {
+		cfg.RefreshAhead = fraction
+		cfg.RefreshWorkers = workers
+	}
+}
+
+// WithOnRefreshError sets Config.OnRefreshError.
+func WithOnRefreshError(f func(id string, err error)) Option {
+	return func(cfg *Config) { cfg.OnRefreshError = f }
+}
+
+// WithListener adds a listener to Config.Listeners. Can be used more than once.
+func WithListener(l PurgeListener) Option {
+	return func(cfg *Config) { cfg.Listeners = append(cfg.Listeners, l) }
+}
+
+// WithStats sets Config.Stats.
+func WithStats() Option {
+	return func(cfg *Config) { cfg.Stats = true }
+}
+
+// WithClone sets Config.Clone.
+func WithClone(f func(Cacheable) Cacheable) Option {
+	return func(cfg *Config) { cfg.Clone = f }
+}
+
+// WithCloneOnSet sets Config.CloneOnSet.
+func WithCloneOnSet() Option {
+	return func(cfg *Config) { cfg.CloneOnSet = true }
+}
+
+// WithCloneOnGet sets Config.CloneOnGet.
+func WithCloneOnGet() Option {
+	return func(cfg *Config) { cfg.CloneOnGet = true }
+}
+
+// WithMutationDetection sets Config.DetectMutation, and Config.OnMutation to
+// f (which may be nil for the default).
+func WithMutationDetection(f func(id string, p Cacheable)) Option {
+	return func(cfg *Config) {
+		cfg.DetectMutation = true
+		cfg.OnMutation = f
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func TestNewWithConfigInvalid(t *testing.T) {
+	invalid := []Config{
+		{MaxSize: -1},
+		{MaxEntries: -1},
+		{MaxEntrySize: -1},
+		{MaxSize: 10, MaxEntrySize: 11},
+		{MaxEntryFraction: -0.1},
+		{MaxEntryFraction: 1.5},
+		{DefaultTTL: -time.Second},
+		{EvictionPolicy: 123},
+		{Listeners: []PurgeListener{nil}},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewWithConfig(cfg); err == nil {
+			t.Errorf("Expected error for invalid config: %+v", cfg)
+		}
+	}
+	if _, err := NewWithOptions(WithMaxSize(-3)); err == nil {
+		t.Error("Expected error for invalid option")
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	var purged []string
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	c, err := NewWithOptions(
+		WithMaxSize(10),
+		WithMaxEntries(2),
+		WithDefaultTTL(time.Minute),
+		WithClock(clock),
+		WithOnMiss(func(id string) (Cacheable, error) {
+			return "loaded " + id, nil
+		}),
+		WithListener(func(id string, p Cacheable, why PurgeReason) {
+			purged = append(purged, id)
+		}),
+		WithStats(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", 1)
+	c.SetWithTTL("b", 2, 0)
+	if v, _ := c.Get("x"); v != "loaded x" {
+		t.Error("Unexpected value from OnMiss:", v)
+	}
+	if len(purged) != 1 || purged[0] != "a" {
+		t.Error("Unexpected purged elements:", purged)
+	}
+	clock.Advance(time.Minute)
+	if _, err := c.Get("b"); err != nil {
+		t.Error("Element without TTL expired")
+	}
+	if v, _ := c.Get("x"); v != "loaded x" {
+		t.Error("Unexpected value after expiry:", v)
+	}
+	s := c.Stats()
+	if s.Hits != 1 || s.Misses != 2 || s.Evictions != 1 || s.Expirations != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	if s.Entries != 2 || s.Size != 2 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+
+	checkDLL(t, c)
+}
+
+func TestTTL(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	c, err := NewWithConfig(Config{Clock: clock, DefaultTTL: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var x, y purgeable
+	c.Set("x", &x)
+	c.SetWithTTL("y", &y, 2*time.Second)
+	clock.Advance(time.Second)
+	if _, err := c.Get("x"); err != ErrNotFound {
+		t.Error("Expected element to expire after default TTL")
+	}
+	if !x.purged || x.why != EXPIRED {
+		t.Error("Expired element not purged with reason EXPIRED")
+	}
+	if _, err := c.Get("y"); err != nil {
+		t.Error("Element expired before its own TTL")
+	}
+	clock.Advance(time.Second)
+	// Expired elements are purged as such when the cache is full
+	c.MaxSize(1)
+	c.Set("z", 3)
+	if !y.purged || y.why != EXPIRED {
+		t.Error("Expired element not purged with reason EXPIRED from full cache")
+	}
+
+	checkDLL(t, c)
+}
+
+func TestFIFO(t *testing.T) {
+	c, err := NewWithConfig(Config{MaxEntries: 2, EvictionPolicy: FIFO})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a")
+	c.Set("c", 3)
+	if _, err := c.Get("a"); err != ErrNotFound {
+		t.Error("Expected oldest element to be purged regardless of use")
+	}
+	if _, err := c.Get("b"); err != nil {
+		t.Error("Expected b to be cached")
+	}
+
+	checkDLL(t, c)
+}
@@ -0,0 +1,78 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotCounter is returned when incrementing an element which is not an
+// int64.
+var ErrNotCounter = errors.New("Element is not a counter")
+
+// CounterOptions configures a counter created by IncrementWithOptions.
+type CounterOptions struct {
+	// Value of a fresh counter, before the delta is applied
+	Initial int64
+	// Time to live of a fresh counter, as in SetWithTTL. Incrementing an
+	// existing counter does not extend it. Leave at 0 for the default time to
+	// live of the cache.
+	TTL time.Duration
+}
+
+// Increment atomically adds delta to the counter stored under id, and returns
+// its new value. A counter is simply an int64 element. If there is no element
+// under id, a counter is created starting at 0. Returns ErrNotCounter if the
+// element is not an int64.
+//
+// The counter is updated in place: it is not purged with reason KEYCOLLISION,
+// as it would be when using Set. It is marked as used, though, and elements
+// depending on it are purged (see SetWithDeps).
+func (c *Cache) Increment(id string, delta int64) (int64, error) {
+	return c.IncrementWithOptions(id, delta, CounterOptions{})
+}
+
+// Decrement atomically subtracts delta from the counter stored under id. See
+// Increment.
+func (c *Cache) Decrement(id string, delta int64) (int64, error) {
+	return c.IncrementWithOptions(id, -delta, CounterOptions{})
+}
+
+// IncrementWithOptions is Increment with control over how a fresh counter is
+// created. E.g. a fixed window rate limit of 100 requests per minute:
+//
+//	n, _ := c.IncrementWithOptions("requests:"+user, 1, lrucache.CounterOptions{
+//	    TTL: time.Minute,
+//	})
+//	if n > 100 {
+//	    // Too many requests
+//	}
+func (c *Cache) IncrementWithOptions(id string, delta int64, opts CounterOptions) (int64, error) {
+	c.lock.Lock()
+	defer c.unlock()
+	if e := liveEntry(c, id); e != nil {
+		n, ok := e.payload.(int64)
+		if !ok {
+			return 0, ErrNotCounter
+		}
+		n += delta
+		e.payload = n
+		e.version++
+		rememberHash(c, e)
+		invalidateDependents(c, id)
+		touchEntry(c, e)
+		return n, nil
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = inheritTTL
+	}
+	n := opts.Initial + delta
+	if err := directSet(c, id, n, ttl); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
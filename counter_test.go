@@ -0,0 +1,70 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func TestIncrement(t *testing.T) {
+	var purges []PurgeReason
+	c, err := NewWithConfig(Config{
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			purges = append(purges, why)
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Increment("n", 2)
+		}()
+	}
+	wg.Wait()
+	if n, err := c.Decrement("n", 1); n != 199 || err != nil {
+		t.Error("Unexpected counter value:", n, err)
+	}
+	if v, _ := c.Get("n"); v != int64(199) {
+		t.Error("Unexpected value from Get:", v)
+	}
+	if len(purges) != 0 {
+		t.Error("Increment purged elements:", purges)
+	}
+	c.Set("s", "not a number")
+	if _, err := c.Increment("s", 1); err != ErrNotCounter {
+		t.Error("Expected ErrNotCounter, got:", err)
+	}
+
+	checkDLL(t, c)
+}
+
+func TestIncrementWithOptions(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	c, err := NewWithConfig(Config{Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := CounterOptions{Initial: 10, TTL: time.Minute}
+	if n, _ := c.IncrementWithOptions("n", 1, opts); n != 11 {
+		t.Error("Unexpected initial value:", n)
+	}
+	clock.Advance(30 * time.Second)
+	if n, _ := c.IncrementWithOptions("n", 1, opts); n != 12 {
+		t.Error("Unexpected value:", n)
+	}
+	// Incrementing did not extend the TTL
+	clock.Advance(30 * time.Second)
+	if n, _ := c.IncrementWithOptions("n", 1, opts); n != 11 {
+		t.Error("Counter did not expire:", n)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+// SetWithDeps stores an item in cache, like Set, which is derived from the
+// elements stored under deps. When any of those is deleted, replaced (by Set,
+// Update, et cetera) or expires, this item is purged with reason DEPENDENCY.
+// Being evicted from a full cache does not count. Dependencies are by id: the
+// dependency needn't be in the cache yet, and it remains in force when the
+// dependency is replaced.
+//
+// Dependencies are transitive: purging this item in turn purges everything
+// depending on it. Cycles are allowed; every element is purged at most once.
+func (c *Cache) SetWithDeps(id string, p Cacheable, deps ...string) {
+	c.setPrepared(id, p, func(e *cacheEntry) {
+		e.deps = append([]string(nil), deps...)
+	})
+}
+
+// depsObsolete reports whether any of the dependencies of an entry is obsolete,
+// directly or indirectly. Dependencies go obsolete (e.g. expire) without
+// anyone noticing until they are requested, so their dependents must check.
+func depsObsolete(c *Cache, e *cacheEntry, visited map[*cacheEntry]bool) bool {
+	for _, id := range e.deps {
+		d, ok := c.entries[id]
+		if !ok || visited[d] {
+			continue
+		}
+		visited[d] = true
+		if _, dead := obsoleteItself(c, d); dead || depsObsolete(c, d, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidateDependents purges everything depending on id, directly or
+// indirectly, with reason DEPENDENCY
+func invalidateDependents(c *Cache, id string) {
+	if len(c.dependents[id]) == 0 {
+		return
+	}
+	visited := map[string]bool{id: true}
+	queue := []string{id}
+	for len(queue) > 0 {
+		var ids []string
+		for dependent := range c.dependents[queue[0]] {
+			ids = append(ids, dependent)
+		}
+		queue = queue[1:]
+		for _, dependent := range ids {
+			if visited[dependent] {
+				continue
+			}
+			visited[dependent] = true
+			if e, ok := c.entries[dependent]; ok {
+				invalidateLoad(c, dependent)
+				purgeSingle(c, e, DEPENDENCY)
+			}
+			queue = append(queue, dependent)
+		}
+	}
+	return
+}
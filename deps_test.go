@@ -0,0 +1,147 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func depsCache(t *testing.T, cfg Config) (*Cache, map[string]PurgeReason) {
+	purged := map[string]PurgeReason{}
+	cfg.Listeners = []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+		if _, ok := purged[id]; ok {
+			t.Error("Purged twice:", id)
+		}
+		purged[id] = why
+	}}
+	c, err := NewWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, purged
+}
+
+func TestSetWithDeps(t *testing.T) {
+	c, purged := depsCache(t, Config{})
+	c.Set("data1", 1)
+	c.Set("data2", 2)
+	c.SetWithDeps("page", 3, "data1", "data2")
+	c.SetWithDeps("site", 4, "page")
+	c.SetWithDeps("other", 5, "data2")
+	c.Delete("data1")
+	want := map[string]PurgeReason{
+		"data1": EXPLICITDELETE,
+		"page":  DEPENDENCY,
+		"site":  DEPENDENCY,
+	}
+	if len(purged) != len(want) {
+		t.Error("Unexpected purges:", purged)
+	}
+	for id, why := range want {
+		if purged[id] != why {
+			t.Errorf("Expected %s purged with %v, got %v", id, why, purged[id])
+		}
+	}
+	if _, err := c.Get("other"); err != nil {
+		t.Error("Unrelated dependent was purged:", err)
+	}
+	// Replacing a dependency
+	c.Set("data2", 6)
+	if purged["other"] != DEPENDENCY {
+		t.Error("Dependent not purged on replacement:", purged)
+	}
+	if len(c.dependents) != 0 {
+		t.Error("Dependency index leaked:", c.dependents)
+	}
+}
+
+func TestSetWithDepsCycle(t *testing.T) {
+	c, purged := depsCache(t, Config{})
+	c.SetWithDeps("a", 1, "c")
+	c.SetWithDeps("b", 2, "a")
+	c.SetWithDeps("c", 3, "b")
+	c.SetWithDeps("d", 4, "d")
+	c.Delete("a")
+	if len(purged) != 3 || purged["b"] != DEPENDENCY || purged["c"] != DEPENDENCY {
+		t.Error("Unexpected purges:", purged)
+	}
+	c.Delete("d")
+	if purged["d"] != EXPLICITDELETE {
+		t.Error("Unexpected purge of self-dependent element:", purged["d"])
+	}
+	if len(c.dependents) != 0 {
+		t.Error("Dependency index leaked:", c.dependents)
+	}
+}
+
+func TestSetWithDepsExpiry(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	c, purged := depsCache(t, Config{Clock: clock, MaxEntries: 3})
+	c.SetWithTTL("data", 1, time.Second)
+	c.SetWithDeps("page", 2, "data")
+	clock.Advance(2 * time.Second)
+	if _, err := c.Get("data"); err != ErrNotFound {
+		t.Error("Expected expired dependency, got", err)
+	}
+	if purged["page"] != DEPENDENCY {
+		t.Error("Dependent not purged on expiry:", purged)
+	}
+	// Without requesting the dependency first
+	delete(purged, "data")
+	delete(purged, "page")
+	c.SetWithTTL("data", 1, time.Second)
+	c.SetWithDeps("page", 2, "data")
+	c.SetWithDeps("site", 3, "page")
+	clock.Advance(2 * time.Second)
+	if _, err := c.Get("site"); err != ErrNotFound {
+		t.Error("Expected indirect dependent of expired element to be purged, got", err)
+	}
+	if _, err := c.Get("page"); err != ErrNotFound {
+		t.Error("Expected dependent of expired element to be purged, got", err)
+	}
+	if purged["site"] != DEPENDENCY || purged["page"] != DEPENDENCY {
+		t.Error("Unexpected purges:", purged)
+	}
+	// Eviction does not cascade
+	c.Delete("data")
+	delete(purged, "data")
+	delete(purged, "page")
+	delete(purged, "site")
+	c.Set("data", 3)
+	c.SetWithDeps("page", 4, "data")
+	c.Set("x", 5)
+	c.Set("y", 6)
+	if purged["data"] != CACHEFULL {
+		t.Error("Expected dependency to be evicted:", purged)
+	}
+	if _, err := c.Get("page"); err != nil {
+		t.Error("Dependent purged on eviction:", err)
+	}
+}
+
+func TestUpdateDeps(t *testing.T) {
+	c, purged := depsCache(t, Config{})
+	c.Set("data", 1)
+	c.SetWithDeps("page", 2, "data")
+	if err := c.Update("data", 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged["page"] != DEPENDENCY {
+		t.Error("Unexpected purges:", purged)
+	}
+}
+
+func TestIncrementDeps(t *testing.T) {
+	c, purged := depsCache(t, Config{})
+	c.Increment("n", 1)
+	c.SetWithDeps("derived", 2, "n")
+	c.Increment("n", 1)
+	if len(purged) != 1 || purged["derived"] != DEPENDENCY {
+		t.Error("Unexpected purges:", purged)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"strings"
+)
+
+// BumpAll logically deletes every element in the cache in constant time, by
+// starting a new generation. Elements from older generations are never
+// returned again: Get treats them as a miss, and purges them with reason
+// GENERATIONBUMP. The others are reclaimed lazily, whenever they are the least
+// recently used element, also with reason GENERATIONBUMP. Until then they
+// take up space in the cache. Elements depending on them (see SetWithDeps)
+// are only purged once they are reclaimed.
+//
+// Results of OnMiss calls in progress are not stored, as with Delete.
+func (c *Cache) BumpAll() {
+	c.lock.Lock()
+	defer c.unlock()
+	c.generation++
+	invalidateLoads(c, "")
+	trimCache(c)
+}
+
+// Bump logically deletes every element in a namespace in constant time, like
+// BumpAll. The namespace is created, without a quota, if it doesn't exist yet.
+// See Cache.Namespace.
+func (c *Cache) Bump(namespace string) {
+	c.lock.Lock()
+	defer c.unlock()
+	bumpNamespace(c, getNamespace(c, namespace))
+}
+
+// Bump logically deletes every element in this namespace in constant time. See
+// Cache.Bump.
+func (ns *Namespace) Bump() {
+	ns.c.lock.Lock()
+	defer ns.c.unlock()
+	bumpNamespace(ns.c, ns)
+}
+
+func bumpNamespace(c *Cache, ns *Namespace) {
+	ns.generation++
+	invalidateLoads(c, ns.prefix)
+	trimCache(c)
+	return
+}
+
+// invalidateLoads marks all loads in progress for ids starting with prefix as
+// stale
+func invalidateLoads(c *Cache, prefix string) {
+	for id, l := range c.loads {
+		if strings.HasPrefix(id, prefix) {
+			l.stale = true
+		}
+	}
+	for id, l := range c.lateLoads {
+		if strings.HasPrefix(id, prefix) {
+			l.stale = true
+		}
+	}
+	return
+}
+
+// staleGeneration reports whether an entry was stored before a bump of the
+// generation of the cache or its namespace
+func staleGeneration(c *Cache, e *cacheEntry) bool {
+	return e.gen != c.generation || (e.ns != nil && e.nsGen != e.ns.generation)
+}
@@ -0,0 +1,90 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"testing"
+)
+
+func TestBump(t *testing.T) {
+	purged := map[string]PurgeReason{}
+	c, err := NewWithConfig(Config{
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			purged[id] = why
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored before the namespace exists
+	c.Set("a:1", 1)
+	a := c.Namespace("a", 0)
+	a.Set("2", 2)
+	c.Set("b:1", 3)
+	c.Set("a:3", 4)
+	c.Bump("a")
+	// Reclaimed lazily, from the end of the LRU list
+	if len(purged) != 2 || purged["a:1"] != GENERATIONBUMP || purged["a:2"] != GENERATIONBUMP {
+		t.Error("Unexpected purges:", purged)
+	}
+	if _, err := a.Get("3"); err != ErrNotFound {
+		t.Error("Expected miss after bump, got", err)
+	}
+	if purged["a:3"] != GENERATIONBUMP {
+		t.Error("Expected Get to purge a:3, got", purged["a:3"])
+	}
+	if v, err := c.Get("b:1"); err != nil || v != 3 {
+		t.Error("Bump affected other namespace:", v, err)
+	}
+	a.Set("3", 5)
+	if v, err := a.Get("3"); err != nil || v != 5 {
+		t.Error("Unexpected value after bump:", v, err)
+	}
+	checkNamespace(t, c, a)
+	checkDLL(t, c)
+}
+
+func TestBumpAll(t *testing.T) {
+	c := New(0)
+	b := c.Namespace("b", 0)
+	c.Set("x", 1)
+	b.Set("y", 2)
+	c.BumpAll()
+	if c.Size() != 0 {
+		t.Error("Expected stale elements to be reclaimed, size:", c.Size())
+	}
+	c.Set("x", 3)
+	b.Set("y", 4)
+	b.Bump()
+	if v, err := c.Get("x"); err != nil || v != 3 {
+		t.Error("Unexpected value after namespace bump:", v, err)
+	}
+	if _, err := b.Get("y"); err != ErrNotFound {
+		t.Error("Expected miss after namespace bump, got", err)
+	}
+}
+
+func TestBumpDuringLoad(t *testing.T) {
+	c := New(0)
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	c.OnMiss(func(id string) (Cacheable, error) {
+		close(started)
+		<-proceed
+		return 1, nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Get("a:x")
+	}()
+	<-started
+	c.Bump("a")
+	close(proceed)
+	<-done
+	if c.Size() != 0 {
+		t.Error("Stored result of load started before bump")
+	}
+}
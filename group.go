@@ -0,0 +1,162 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"errors"
+	"sync"
+)
+
+// Group unifies concurrent calls for the same key into one call, whose result
+// is shared by all callers. Calls for different keys proceed concurrently.
+//
+// The zero value is ready for use. A Group must not be copied after first use.
+type Group struct {
+	lock   sync.Mutex
+	calls  map[string]*groupCall
+	closed bool
+	stats  GroupStats
+}
+
+// groupCall is a single call in progress (or just completed)
+type groupCall struct {
+	// Closed once val and err are set
+	done chan struct{}
+	val  Cacheable
+	err  error
+	// Number of callers waiting for this call besides the one that started it
+	dups int
+}
+
+// Result is the outcome of a call through Group.DoChan.
+type Result struct {
+	Val Cacheable
+	Err error
+	// Whether this result was handed to more than one caller
+	Shared bool
+}
+
+// GroupStats counts the calls made through a Group.
+type GroupStats struct {
+	// Number of times a function was actually executed
+	Calls int64
+	// Number of callers which got the result of a call started by another
+	Shared int64
+}
+
+var ErrGroupClosed = errors.New("Group has been closed")
+
+// Do calls fn and returns its results, unless a call for the same key is
+// already in progress, in which case it waits for that call to finish and
+// returns its results instead. The third return value reports whether the
+// result was handed to more than one caller.
+//
+// After Close, returns ErrGroupClosed without calling fn.
+func (g *Group) Do(key string, fn func() (Cacheable, error)) (Cacheable, error, bool) {
+	gc, leader, err := g.join(key)
+	if err != nil {
+		return nil, err, false
+	}
+	if leader {
+		g.run(key, gc, fn)
+	} else {
+		<-gc.done
+	}
+	return gc.val, gc.err, g.shared(gc)
+}
+
+// DoChan is like Do, but doesn't wait for the result. Instead, the result is
+// sent down the returned channel once it is ready. The channel is buffered; it
+// is fine not to read from it.
+func (g *Group) DoChan(key string, fn func() (Cacheable, error)) <-chan Result {
+	ch := make(chan Result, 1)
+	gc, leader, err := g.join(key)
+	if err != nil {
+		ch <- Result{Err: err}
+		return ch
+	}
+	go func() {
+		if leader {
+			g.run(key, gc, fn)
+		} else {
+			<-gc.done
+		}
+		ch <- Result{Val: gc.val, Err: gc.err, Shared: g.shared(gc)}
+	}()
+	return ch
+}
+
+// join finds the call in progress for this key or starts a new one, in which
+// case the caller is its leader and must run it.
+func (g *Group) join(key string) (gc *groupCall, leader bool, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return nil, false, ErrGroupClosed
+	}
+	if gc, ok := g.calls[key]; ok {
+		gc.dups++
+		g.stats.Shared++
+		return gc, false, nil
+	}
+	if g.calls == nil {
+		g.calls = map[string]*groupCall{}
+	}
+	gc = &groupCall{done: make(chan struct{})}
+	g.calls[key] = gc
+	g.stats.Calls++
+	return gc, true, nil
+}
+
+// run executes the call and releases everyone waiting for it. A panic in fn is
+// returned to all of them as a *PanicError.
+func (g *Group) run(key string, gc *groupCall, fn func() (Cacheable, error)) {
+	gc.val, gc.err = protect(fn)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	// Unless forgotten, and perhaps replaced by a fresh call already
+	if g.calls[key] == gc {
+		delete(g.calls, key)
+	}
+	close(gc.done)
+}
+
+func (g *Group) shared(gc *groupCall) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return gc.dups > 0
+}
+
+// Forget makes the group forget about the call in progress for this key, if
+// any. The next call for this key will not wait for it, but start afresh.
+// Callers already waiting for the forgotten call still get its result.
+func (g *Group) Forget(key string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.calls, key)
+}
+
+// InFlight returns the number of keys with a call in progress.
+func (g *Group) InFlight() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return len(g.calls)
+}
+
+// Stats returns a snapshot of the call counters of this group.
+func (g *Group) Stats() GroupStats {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.stats
+}
+
+// Close stops the group from accepting new calls. Calls in progress complete
+// normally, and callers waiting for them still get their results. Closing a
+// group more than once is fine.
+func (g *Group) Close() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.closed = true
+}
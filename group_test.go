@@ -0,0 +1,100 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestGroupDo(t *testing.T) {
+	var g Group
+	release := make(chan bool)
+	started := make(chan bool)
+	calls := counter()
+	fn := func() (Cacheable, error) {
+		calls()
+		started <- true
+		<-release
+		return 42, nil
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		val, err, shared := g.Do("foo", fn)
+		if val != 42 || err != nil || !shared {
+			t.Error("Unexpected result from leader:", val, err, shared)
+		}
+	}()
+	<-started
+	if g.InFlight() != 1 {
+		t.Error("Unexpected number of keys in flight:", g.InFlight())
+	}
+	// DoChan joins the call in progress before returning
+	ch := g.DoChan("foo", fn)
+	close(release)
+	res := <-ch
+	if res.Val != 42 || res.Err != nil || !res.Shared {
+		t.Errorf("Unexpected result from follower: %+v", res)
+	}
+	wg.Wait()
+	if n := calls() - 1; n != 1 {
+		t.Errorf("Function called too often (%d times)", n)
+	}
+	if g.InFlight() != 0 {
+		t.Error("Unexpected number of keys in flight:", g.InFlight())
+	}
+	s := g.Stats()
+	if s.Calls != 1 || s.Shared != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	// Sequential calls are not shared
+	go func() { <-started }()
+	_, _, shared := g.Do("foo", fn)
+	if shared {
+		t.Error("Sequential call reported as shared")
+	}
+}
+
+func TestGroupForget(t *testing.T) {
+	var g Group
+	release := make(chan bool)
+	started := make(chan bool)
+	go g.Do("foo", func() (Cacheable, error) {
+		started <- true
+		<-release
+		return 1, nil
+	})
+	<-started
+	g.Forget("foo")
+	val, _, shared := g.Do("foo", func() (Cacheable, error) {
+		return 2, nil
+	})
+	if val != 2 || shared {
+		t.Error("Call after Forget joined forgotten call:", val, shared)
+	}
+	close(release)
+}
+
+func TestGroupClose(t *testing.T) {
+	var g Group
+	release := make(chan bool)
+	started := make(chan bool)
+	ch := g.DoChan("foo", func() (Cacheable, error) {
+		started <- true
+		<-release
+		return 1, nil
+	})
+	<-started
+	g.Close()
+	if _, err, _ := g.Do("bar", func() (Cacheable, error) { return 2, nil }); err != ErrGroupClosed {
+		t.Error("Expected ErrGroupClosed after Close, got:", err)
+	}
+	close(release)
+	if res := <-ch; res.Val != 1 || res.Err != nil {
+		t.Errorf("Call in progress did not complete after Close: %+v", res)
+	}
+}
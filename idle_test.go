@@ -0,0 +1,95 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	purged := map[string]PurgeReason{}
+	c, err := NewWithConfig(Config{
+		Clock: clock,
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			purged[id] = why
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWithIdleTimeout("session", 1, 10*time.Second)
+	for i := 0; i < 5; i++ {
+		clock.Advance(8 * time.Second)
+		if _, err := c.Get("session"); err != nil {
+			t.Fatal("Session expired while in use:", err)
+		}
+	}
+	clock.Advance(10 * time.Second)
+	if _, err := c.Get("session"); err != ErrNotFound {
+		t.Error("Expected idle session to expire, got", err)
+	}
+	if purged["session"] != IDLETIMEOUT {
+		t.Error("Unexpected purge reason:", purged["session"])
+	}
+	// Reclaimed from the end of the LRU list
+	c.SetWithIdleTimeout("old", 2, time.Second)
+	c.Set("forever", 3)
+	clock.Advance(time.Second)
+	c.Set("new", 4)
+	if purged["old"] != IDLETIMEOUT {
+		t.Error("Expected idle element to be reclaimed, got", purged)
+	}
+	if _, ok := purged["forever"]; ok {
+		t.Error("Element without idle timeout was purged")
+	}
+}
+
+func TestDefaultIdleTimeout(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	c, err := NewWithOptions(WithClock(clock), WithDefaultIdleTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", 1)
+	c.SetWithIdleTimeout("b", 2, 0)
+	clock.Advance(time.Second)
+	if _, err := c.Get("a"); err != ErrNotFound {
+		t.Error("Expected default idle timeout to apply, got", err)
+	}
+	if _, err := c.Get("b"); err != nil {
+		t.Error("Expected explicit timeout of 0 to never expire, got", err)
+	}
+	if _, err := NewWithConfig(Config{DefaultIdleTimeout: -1}); err == nil {
+		t.Error("Expected negative idle timeout to be rejected")
+	}
+}
+
+func TestIdleTimeoutUpdate(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	c, err := NewWithOptions(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWithIdleTimeout("a", 1, 10*time.Second)
+	c.SetWithIdleTimeout("b", 1, 10*time.Second)
+	clock.Advance(9 * time.Second)
+	if err := c.Update("a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateWithOptions("b", 2, UpdateOptions{KeepRecency: true}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second)
+	if v, err := c.Get("a"); err != nil || v != 2 {
+		t.Error("Update did not mark element as used:", v, err)
+	}
+	if _, err := c.Get("b"); err != ErrNotFound {
+		t.Error("Update with KeepRecency marked element as used:", err)
+	}
+}
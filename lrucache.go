@@ -39,13 +39,16 @@
 // * These integers are passed by value. Caching pointers is, of course, Okay,
 // but be careful when caching a memory location that holds two different
 // values at different points in time; updating the value of a pointer after
-// caching it will change the cached value.
+// caching it will change the cached value. See Config.CloneOnSet and
+// Config.CloneOnGet to cache copies instead, and Config.DetectMutation to find
+// out where this happens.
 //
 package lrucache
 
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 // A function that generates a fresh entry on "cache miss". See the Cache.OnMiss
@@ -65,13 +68,67 @@ type Cache struct {
 	// operations, but it seems hardly worth it.
 	size    int64
 	maxSize int64
-	entries map[string]*cacheEntry
+	// Number of entries in the LRU list (i.e. excluding size 0 entries)
+	count      int64
+	maxEntries int64
+	// Largest size a single element may have, 0 for no limit
+	maxEntrySize int64
+	// Largest size a single element may have as a fraction of maxSize, 0 for
+	// no limit
+	maxEntryFraction float64
+	entries      map[string]*cacheEntry
 	// most recently used entry
 	mostRU *cacheEntry
 	// least recently used entry
 	leastRU *cacheEntry
 	// If not nil, invoked for every cache miss.
 	onMiss OnMissHandler
+	// Calls to onMiss in progress, unless concurrentMisses is set
+	loads            map[string]*pendingLoad
+	concurrentMisses bool
+	// Calls to onMiss which timed out but might still produce a value, see
+	// WithTimeout
+	lateLoads map[string]*pendingLoad
+	// Time to live for elements stored without an explicit one, 0 for none
+	defaultTTL time.Duration
+	// See Config.DefaultIdleTimeout
+	defaultIdleTimeout time.Duration
+	policy             EvictionPolicy
+	clock              Clock
+	listeners          []PurgeListener
+	// How long to remember OnMiss misses and errors, 0 for not at all
+	negativeTTL  time.Duration
+	errorTTL     time.Duration
+	negativeSize int64
+	// Secondary indexes: ids by tag, and all ids by prefix. The latter is only
+	// built once it's first needed.
+	tags     map[string]map[string]struct{}
+	keyIndex *keyTrie
+	// Ids of the elements depending on an id
+	dependents map[string]map[string]struct{}
+	// See Cache.Namespace
+	namespaces map[string]*Namespace
+	overQuota  map[*Namespace]struct{}
+	// See Cache.BumpAll
+	generation uint64
+	// See Config.RefreshAhead
+	refreshAhead   float64
+	refreshWorkers int
+	onRefreshError func(id string, err error)
+	// Number of refreshes in progress
+	refreshing int
+	// First panic in an OnPurge or listener while the lock was held, to be
+	// raised again once it is released. See Cache.unlock.
+	purgePanic *PanicError
+	// Only keep statistics if explicitly asked to
+	countStats bool
+	// See Config.Clone and related
+	clone          func(Cacheable) Cacheable
+	cloneOnSet     bool
+	cloneOnGet     bool
+	detectMutation bool
+	onMutation     func(id string, p Cacheable)
+	stats          Stats
 }
 
 // Anything can be cached!
@@ -93,6 +150,30 @@ func getSize(x Cacheable) int64 {
 	return 1
 }
 
+// Optional interface for cached objects which know when they go stale, e.g. an
+// OAuth token with an embedded expiry time. Checked on every Get, alongside the
+// time to live of the element (whichever comes first). Once this time has
+// passed, Get treats the element as a miss and purges it with reason EXPIRED.
+type Expirer interface {
+	// Return the zero time for never
+	ExpiresAt() time.Time
+}
+
+// Optional interface for cached objects which can tell for themselves whether
+// they can still be used. Checked on every Get: once an element is no longer
+// valid, Get treats it as a miss and purges it with reason INVALID.
+//
+// Called with the cache locked. Keep it cheap, and don't touch the cache.
+type Validator interface {
+	Valid() bool
+}
+
+// Optional interface for cached objects which can make a deep copy of
+// themselves. See Config.CloneOnSet and Config.CloneOnGet.
+type Cloner interface {
+	Clone() Cacheable
+}
+
 // Reasons for a cached element to be deleted from the cache
 type PurgeReason int
 
@@ -103,8 +184,37 @@ const (
 	EXPLICITDELETE
 	// A new element with the same key is stored (usually indicates an update)
 	KEYCOLLISION
+	// The time to live of this item has passed, or the time reported by its
+	// Expirer
+	EXPIRED
+	// This item was replaced in place using Cache.UpdateWithOptions
+	REPLACED
+	// An item this one depends on was deleted, replaced or expired. See
+	// Cache.SetWithDeps.
+	DEPENDENCY
+	// The generation of the cache or the namespace of this item was bumped
+	// since it was stored. See Cache.Bump.
+	GENERATIONBUMP
+	// This item was not requested for too long. See Cache.SetWithIdleTimeout.
+	IDLETIMEOUT
+	// This item reported itself as no longer valid. See Validator.
+	INVALID
 )
 
+// A function that is notified of every element purged from a cache, along with
+// its id. Unlike NotifyPurge this applies to every element, regardless of its
+// type. Listeners are called under the same conditions as OnPurge; see
+// NotifyPurge.
+type PurgeListener func(id string, p Cacheable, why PurgeReason)
+
+// Optional interface for cached objects, see Cache.UpdateWithOptions
+type NotifyReplace interface {
+	// Called once when the element is replaced in place by another, which is
+	// passed as the argument. Called instead of OnPurge(REPLACED), under the
+	// same conditions.
+	OnReplace(replacement Cacheable)
+}
+
 // Optional interface for cached objects
 type NotifyPurge interface {
 	// Called once when the element is purged from cache. The argument
@@ -127,22 +237,108 @@ type NotifyPurge interface {
 type cacheEntry struct {
 	payload Cacheable
 	id      string
+	// Size of the payload as reported when it was stored
+	size int64
+	// Only set for negative entries, which have no payload: the result of
+	// looking up this id through OnMiss. See Config.NegativeTTL.
+	err error
+	// Zero if this entry never expires
+	expires time.Time
+	// Time to live this entry was stored with, to reuse when refreshing it
+	ttl time.Duration
+	// Zero if this entry never expires for lack of use. See
+	// Cache.SetWithIdleTimeout.
+	idleTimeout time.Duration
+	lastAccess  time.Time
+	// When to start refreshing this entry in the background, zero for never.
+	// See Config.RefreshAhead.
+	refreshAt  time.Time
+	refreshing bool
+	// Bumped on every in-place change of the payload
+	version uint64
+	// See Cache.SetWithTags
+	tags []string
+	// See Cache.SetWithDeps
+	deps []string
 	// youngest older entry (age being usage) (DLL pointer)
 	older *cacheEntry
 	// oldest younger entry (age being usage) (DLL pointer)
 	younger *cacheEntry
+	// Namespace this entry belongs to, if any, and its own LRU list in there
+	ns        *Namespace
+	nsOlder   *cacheEntry
+	nsYounger *cacheEntry
+	// Generations of the cache and the namespace when this entry was stored.
+	// See Cache.Bump.
+	gen   uint64
+	nsGen uint64
+	// Deep hash of the payload as it was stored, see Config.DetectMutation
+	hash uint64
 }
 
-// Only call c.OnPurge() if c implements NotifyPurge.
-func safeOnPurge(c Cacheable, why PurgeReason) {
+// Only call c.OnPurge() if c implements NotifyPurge. Returns a panic, if any.
+func safeOnPurge(c Cacheable, why PurgeReason) *PanicError {
 	if t, ok := c.(NotifyPurge); ok {
-		t.OnPurge(why)
+		return catchPanic(func() { t.OnPurge(why) })
+	}
+	return nil
+}
+
+// rejectEntry tells everyone interested that an element is purged right away,
+// with reason CACHEFULL, because it can never fit in the cache. Returns the
+// first panic, if any.
+func rejectEntry(c *Cache, id string, p Cacheable) *PanicError {
+	pe := safeOnPurge(p, CACHEFULL)
+	for _, l := range c.listeners {
+		if lp := catchPanic(func() { l(id, p, CACHEFULL) }); pe == nil {
+			pe = lp
+		}
 	}
+	return pe
+}
+
+// notePanic remembers the first panic from a purge callback while the lock is
+// held
+func notePanic(c *Cache, p *PanicError) {
+	if p != nil && c.purgePanic == nil {
+		c.purgePanic = p
+	}
+	return
+}
+
+// dropPanic forgets about any panic in a purge callback, for use in background
+// goroutines which have nobody to raise it to
+func dropPanic(c *Cache) {
+	c.purgePanic = nil
 	return
 }
 
+// unlock releases the write lock, after which any panic caught in a purge
+// callback while it was held is raised again. Use this instead of
+// c.lock.Unlock() wherever elements can be purged.
+func (c *Cache) unlock() {
+	p := c.purgePanic
+	c.purgePanic = nil
+	c.lock.Unlock()
+	if p != nil {
+		panic(p)
+	}
+}
+
 func removeEntry(c *Cache, e *cacheEntry) {
 	delete(c.entries, e.id)
+	unindexEntry(c, e)
+	unlinkEntry(c, e)
+	return
+}
+
+// unlinkEntry takes an entry out of the LRU list, if it's in there
+func unlinkEntry(c *Cache, e *cacheEntry) {
+	size := e.size
+	if size == 0 {
+		// Never made it into the LRU list
+		return
+	}
 	if e.older == nil {
 		c.leastRU = e.younger
 	} else {
@@ -153,119 +349,629 @@ func removeEntry(c *Cache, e *cacheEntry) {
 	} else {
 		e.younger.older = e.older
 	}
-	c.size -= getSize(e.payload)
+	e.older = nil
+	e.younger = nil
+	c.size -= size
+	c.count--
+	if e.ns != nil {
+		nsUnlinkEntry(e.ns, e)
+	}
 	return
 }
 
-// purgeLRU removes the least recently used from the cache
-func purgeLRU(c *Cache) {
-	safeOnPurge(c.leastRU.payload, CACHEFULL)
-	removeEntry(c, c.leastRU)
+// linkEntry puts an entry in the LRU list as the most recently used one,
+// unless it has size 0. Does not trim the cache.
+func linkEntry(c *Cache, e *cacheEntry) {
+	if e.size == 0 {
+		return
+	}
+	if c.leastRU == nil { // aka "if this is the first entry..."
+		// init DLL
+		c.leastRU = e
+		c.mostRU = e
+		e.younger = nil
+		e.older = nil
+	} else {
+		// e is younger than the old "most recently used"
+		c.mostRU.younger = e
+		e.older = c.mostRU
+		c.mostRU = e
+	}
+	c.size += e.size
+	c.count++
+	if e.ns != nil {
+		nsLinkEntry(c, e.ns, e)
+	}
 	return
 }
 
-// trimCache removes elements from the cache until its size <= max size
-func trimCache(c *Cache) {
-	if c.maxSize <= 0 {
+// resizeEntry changes the size of an entry without moving it in the LRU list.
+// Both the old and the new size must be non-zero. Does not trim the cache.
+func resizeEntry(c *Cache, e *cacheEntry, size int64) {
+	c.size += size - e.size
+	if e.ns != nil {
+		e.ns.size += size - e.size
+		checkQuota(c, e.ns)
+	}
+	e.size = size
+	return
+}
+
+// purgeEntry notifies all interested parties and removes the entry
+func purgeEntry(c *Cache, e *cacheEntry, why PurgeReason) {
+	purgeSingle(c, e, why)
+	// Running out of space doesn't make anyone's data stale
+	if why != CACHEFULL {
+		invalidateDependents(c, e.id)
+	}
+	return
+}
+
+// purgeSingle is purgeEntry without invalidating dependents
+func purgeSingle(c *Cache, e *cacheEntry, why PurgeReason) {
+	if e.err != nil {
+		// Negative entries are nobody's business
+		removeEntry(c, e)
 		return
 	}
-	for c.size > c.maxSize {
-		purgeLRU(c)
+	checkMutation(c, e)
+	notePanic(c, safeOnPurge(e.payload, why))
+	for _, l := range c.listeners {
+		notePanic(c, catchPanic(func() { l(e.id, e.payload, why) }))
 	}
+	if c.countStats {
+		switch why {
+		case CACHEFULL:
+			c.stats.Evictions++
+			if e.ns != nil {
+				e.ns.stats.Evictions++
+			}
+		case EXPIRED:
+			c.stats.Expirations++
+			if e.ns != nil {
+				e.ns.stats.Expirations++
+			}
+		}
+	}
+	removeEntry(c, e)
 	return
 }
 
-// directSet sets an entry in the cache without managing locks
-func directSet(c *Cache, id string, payload Cacheable) {
-	// Overwrite old entry
-	if old, ok := c.entries[id]; ok {
-		safeOnPurge(old.payload, KEYCOLLISION)
-		removeEntry(c, old)
+// expired reports whether the entry has outlived its time to live, or the
+// expiry time of its payload
+func expired(c *Cache, e *cacheEntry) bool {
+	if !e.expires.IsZero() && !c.clock.Now().Before(e.expires) {
+		return true
+	}
+	if x, ok := e.payload.(Expirer); ok {
+		t := x.ExpiresAt()
+		return !t.IsZero() && !c.clock.Now().Before(t)
+	}
+	return false
+}
+
+// valid reports whether the payload of the entry considers itself valid
+func valid(e *cacheEntry) bool {
+	if v, ok := e.payload.(Validator); ok {
+		return v.Valid()
+	}
+	return true
+}
+
+// idle reports whether the entry has gone unused for its idle timeout
+func idle(c *Cache, e *cacheEntry) bool {
+	return e.idleTimeout > 0 && !c.clock.Now().Before(e.lastAccess.Add(e.idleTimeout))
+}
+
+// obsolete reports whether an entry must not be served anymore, and why
+func obsolete(c *Cache, e *cacheEntry) (PurgeReason, bool) {
+	if why, dead := obsoleteItself(c, e); dead {
+		return why, true
+	}
+	if len(e.deps) > 0 && depsObsolete(c, e, map[*cacheEntry]bool{e: true}) {
+		return DEPENDENCY, true
+	}
+	return 0, false
+}
+
+// obsoleteItself is obsolete, regardless of dependencies
+func obsoleteItself(c *Cache, e *cacheEntry) (PurgeReason, bool) {
+	switch {
+	case staleGeneration(c, e):
+		return GENERATIONBUMP, true
+	case expired(c, e):
+		return EXPIRED, true
+	case idle(c, e):
+		return IDLETIMEOUT, true
+	case !valid(e):
+		return INVALID, true
+	}
+	return 0, false
+}
+
+// purgeLRU removes a least recently used entry (of the cache or a namespace)
+func purgeLRU(c *Cache, e *cacheEntry) {
+	why, ok := obsolete(c, e)
+	if !ok {
+		why = CACHEFULL
+	}
+	purgeEntry(c, e, why)
+	return
+}
+
+// overLimit reports whether the cache exceeds either its size or its entry
+// count limit
+func overLimit(c *Cache) bool {
+	if c.maxSize > 0 && c.size > c.maxSize {
+		return true
+	}
+	if c.maxEntries > 0 && c.count > c.maxEntries {
+		return true
+	}
+	return false
+}
+
+// trimCache removes elements from the cache until every namespace is within
+// its quota, and the cache within both its max size and its max number of
+// entries
+func trimCache(c *Cache) {
+	for ns := range c.overQuota {
+		for ns.leastRU != nil && ns.size > ns.quota {
+			purgeLRU(c, ns.leastRU)
+		}
+		delete(c.overQuota, ns)
+	}
+	// Stale generations and idle elements are reclaimed as they reach the end
+	// of the line
+	for c.leastRU != nil && (overLimit(c) || staleGeneration(c, c.leastRU) || idle(c, c.leastRU)) {
+		purgeLRU(c, c.leastRU)
+	}
+	return
+}
+
+// fits reports whether an element of this size could ever be stored under
+// this id
+func fits(c *Cache, id string, size int64) bool {
+	if c.maxSize > 0 && size > c.maxSize {
+		return false
+	}
+	if c.maxEntrySize > 0 && size > c.maxEntrySize {
+		return false
+	}
+	if c.maxEntryFraction > 0 && c.maxSize > 0 && float64(size) > c.maxEntryFraction*float64(c.maxSize) {
+		return false
+	}
+	if ns := namespaceOf(c, id); ns != nil && ns.quota > 0 && size > ns.quota {
+		return false
+	}
+	return true
+}
+
+// Special ttl value for directSet: use the default of the cache
+const inheritTTL time.Duration = -1
+
+// directSet sets an entry in the cache without managing locks. Returns
+// ErrTooLarge, without touching the cache, if the payload can never fit. A ttl
+// of 0 means the entry never expires.
+func directSet(c *Cache, id string, payload Cacheable, ttl time.Duration) error {
+	e, err := newEntry(c, id, payload, ttl)
+	if err != nil {
+		return err
+	}
+	insertEntry(c, e)
+	return nil
+}
+
+// newEntry creates an entry without storing it, or returns ErrTooLarge. See
+// directSet.
+func newEntry(c *Cache, id string, payload Cacheable, ttl time.Duration) (*cacheEntry, error) {
+	if ttl == inheritTTL {
+		ttl = c.defaultTTL
+	}
+	if c.cloneOnSet {
+		payload = cloneValue(c, payload)
 	}
-	e := cacheEntry{payload: payload, id: id}
-	c.entries[id] = &e
 	size := getSize(payload)
-	if size == 0 {
+	if !fits(c, id, size) {
+		return nil, ErrTooLarge
+	}
+	e := cacheEntry{payload: payload, id: id, size: size, ttl: ttl}
+	rememberHash(c, &e)
+	if c.defaultIdleTimeout > 0 {
+		e.idleTimeout = c.defaultIdleTimeout
+		e.lastAccess = c.clock.Now()
+	}
+	renewExpiry(c, &e)
+	return &e, nil
+}
+
+// renewExpiry sets the expiry and refresh times of an entry, counting its time
+// to live from now
+func renewExpiry(c *Cache, e *cacheEntry) {
+	if e.ttl > 0 {
+		now := c.clock.Now()
+		e.expires = now.Add(e.ttl)
+		if c.refreshAhead > 0 {
+			e.refreshAt = now.Add(time.Duration(float64(e.ttl) * c.refreshAhead))
+		}
+	}
+	return
+}
+
+// directSetNegative remembers that looking up this id resulted in an error
+// (usually ErrNotFound), for the given duration
+func directSetNegative(c *Cache, id string, err error, ttl time.Duration) {
+	if !fits(c, id, c.negativeSize) {
 		return
 	}
-	if c.leastRU == nil { // aka "if this is the first entry..."
-		// init DLL
-		c.leastRU = &e
-		c.mostRU = &e
-		e.younger = nil
-		e.older = nil
-	} else {
-		// e is younger than the old "most recently used"
-		c.mostRU.younger = &e
-		e.older = c.mostRU
-		c.mostRU = &e
+	e := cacheEntry{id: id, err: err, size: c.negativeSize}
+	e.expires = c.clock.Now().Add(ttl)
+	insertEntry(c, &e)
+	return
+}
+
+// insertEntry stores a fresh entry as the most recently used one, replacing
+// any old entry with the same id
+func insertEntry(c *Cache, e *cacheEntry) {
+	invalidateLoad(c, e.id)
+	// Overwrite old entry
+	if old, ok := c.entries[e.id]; ok {
+		purgeEntry(c, old, KEYCOLLISION)
 	}
-	c.size += size
+	c.entries[e.id] = e
+	e.ns = namespaceOf(c, e.id)
+	e.gen = c.generation
+	if e.ns != nil {
+		e.nsGen = e.ns.generation
+	}
+	indexEntry(c, e)
+	linkEntry(c, e)
 	trimCache(c)
 	return
 }
 
-// handleCacheMiss calls the onMiss handler (if any) and stores the result
-func handleCacheMiss(c *Cache, id string) (Cacheable, error) {
+// pendingLoad is a call to the OnMiss handler in progress, shared by all
+// concurrent Gets for its id
+type pendingLoad struct {
+	// Closed once val and err are set
+	done chan struct{}
+	val  Cacheable
+	err  error
+	// Set when the id is stored or deleted while loading, making the result
+	// of this load stale
+	stale bool
+}
+
+// startLoad registers a load for this id, unless one is already in progress.
+// Returns the load and whether the caller is responsible for it. If misses are
+// not coalesced, the load is nil and the caller always responsible.
+func startLoad(c *Cache, id string) (*pendingLoad, bool) {
+	if c.concurrentMisses || c.onMiss == nil {
+		return nil, true
+	}
+	if l, ok := c.loads[id]; ok {
+		return l, false
+	}
+	l := &pendingLoad{done: make(chan struct{})}
+	c.loads[id] = l
+	return l, true
+}
+
+// invalidateLoad marks the loads in progress for this id, if any, as stale
+func invalidateLoad(c *Cache, id string) {
+	if l, ok := c.loads[id]; ok {
+		l.stale = true
+	}
+	if l, ok := c.lateLoads[id]; ok {
+		l.stale = true
+	}
+	return
+}
+
+// storeLate waits in the background for a load which timed out, and stores
+// its result unless it has gone stale by then. The same timed out load can
+// reach more than one cache miss (e.g. through NoConcurrentDupes), but only the
+// first waits for it.
+func storeLate(c *Cache, id string, late *pendingLoad) {
+	if c.lateLoads[id] == late || late.stale {
+		return
+	}
+	invalidateLoad(c, id)
+	c.lateLoads[id] = late
+	go func() {
+		<-late.done
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.lateLoads[id] == late {
+			delete(c.lateLoads, id)
+		}
+		if !late.stale && late.err == nil && late.val != nil {
+			directSet(c, id, late.val, inheritTTL)
+			dropPanic(c)
+		}
+		// Used up: don't let a straggler store it again
+		late.stale = true
+	}()
+	return
+}
+
+// handleCacheMiss calls the onMiss handler (if any) and stores the result. If
+// l is not nil, its result is shared with everyone waiting for it.
+func handleCacheMiss(c *Cache, id string, l *pendingLoad) (Cacheable, error) {
 	var val Cacheable
 	var err error = ErrNotFound
 	c.lock.RLock()
 	onmiss := c.onMiss
 	c.lock.RUnlock()
 	if onmiss != nil {
-		val, err = onmiss(id)
-		if err == nil {
-			if val != nil {
-				c.lock.Lock()
-				defer c.lock.Unlock()
-				directSet(c, id, val)
-			} else {
-				err = ErrNotFound
-			}
+		val, err = protect(func() (Cacheable, error) { return onmiss(id) })
+	}
+	notFound := err == nil && val == nil
+	if notFound {
+		err = ErrNotFound
+	}
+	c.lock.Lock()
+	defer c.unlock()
+	if l != nil {
+		delete(c.loads, id)
+		l.val, l.err = val, err
+		close(l.done)
+		if l.stale {
+			// Don't overwrite what happened in the mean time
+			return val, err
 		}
 	}
+	switch {
+	case onmiss == nil:
+		break
+	case notFound:
+		if c.negativeTTL > 0 {
+			directSetNegative(c, id, err, c.negativeTTL)
+		}
+	case err != nil:
+		var te *TimeoutError
+		if errors.As(err, &te) && te.late != nil {
+			storeLate(c, id, te.late)
+		} else if c.errorTTL > 0 {
+			directSetNegative(c, id, err, c.errorTTL)
+		}
+	default:
+		// Too large to cache is not this caller's problem
+		directSet(c, id, val, inheritTTL)
+	}
 	return val, err
 }
 
 func (c *Cache) Init(maxsize int64) {
-	c.maxSize = maxsize
+	c.init(Config{MaxSize: maxsize})
+	return
+}
+
+// init applies a (validated) configuration to a fresh cache
+func (c *Cache) init(cfg Config) {
+	c.maxSize = cfg.MaxSize
+	c.maxEntries = cfg.MaxEntries
+	c.maxEntrySize = cfg.MaxEntrySize
+	c.maxEntryFraction = cfg.MaxEntryFraction
+	c.defaultTTL = cfg.DefaultTTL
+	c.defaultIdleTimeout = cfg.DefaultIdleTimeout
+	c.onMiss = cfg.OnMiss
+	c.policy = cfg.EvictionPolicy
+	c.clock = cfg.Clock
+	if c.clock == nil {
+		c.clock = realClock{}
+	}
+	c.listeners = cfg.Listeners
+	c.negativeTTL = cfg.NegativeTTL
+	c.errorTTL = cfg.ErrorTTL
+	c.negativeSize = cfg.NegativeSize
+	if c.negativeSize == 0 {
+		c.negativeSize = 1
+	}
+	c.countStats = cfg.Stats
+	c.clone = cfg.Clone
+	c.cloneOnSet = cfg.CloneOnSet
+	c.cloneOnGet = cfg.CloneOnGet
+	c.detectMutation = cfg.DetectMutation
+	c.onMutation = cfg.OnMutation
+	c.concurrentMisses = cfg.ConcurrentMisses
+	c.refreshAhead = cfg.RefreshAhead
+	c.refreshWorkers = cfg.RefreshWorkers
+	if c.refreshWorkers == 0 {
+		c.refreshWorkers = 1
+	}
+	c.onRefreshError = cfg.OnRefreshError
 	c.entries = map[string]*cacheEntry{}
+	c.loads = map[string]*pendingLoad{}
+	c.lateLoads = map[string]*pendingLoad{}
+	c.tags = map[string]map[string]struct{}{}
+	c.dependents = map[string]map[string]struct{}{}
+	c.namespaces = map[string]*Namespace{}
+	c.overQuota = map[*Namespace]struct{}{}
 	return
 }
 
 // Set stores an item in cache. Panics if the cacheable is nil. It can, however, be
 // an interface pointer to nil.
 // TODO: write a test for the above.
+//
+// If the item is too large to ever fit in the cache (see MaxSize, MaxEntrySize
+// and MaxEntryFraction) it is not stored, and its OnPurge and the purge
+// listeners are called immediately with reason CACHEFULL. Any element previously stored under this id is left
+// untouched. Use TrySet to find out whether an item was stored.
+//
+// The item expires after the default time to live of the cache, if any.
 func (c *Cache) Set(id string, p Cacheable) {
+	if err := c.trySet(id, p, inheritTTL); err == ErrTooLarge {
+		if pe := rejectEntry(c, id, p); pe != nil {
+			panic(pe)
+		}
+	}
+}
+
+// SetWithTTL stores an item in cache, like Set, which expires after the given
+// duration. An expired item is purged with reason EXPIRED, either when it is
+// next requested (in which case Get treats it as a miss) or when it is the
+// least recently used item in a full cache. A ttl of 0 means the item never
+// expires, regardless of the default time to live of the cache.
+func (c *Cache) SetWithTTL(id string, p Cacheable, ttl time.Duration) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	if err := c.trySet(id, p, ttl); err == ErrTooLarge {
+		if pe := rejectEntry(c, id, p); pe != nil {
+			panic(pe)
+		}
+	}
+}
+
+// SetWithIdleTimeout stores an item in cache, like Set, which expires once it
+// hasn't been requested for the given duration. Every Get resets the timer,
+// like a session which stays alive while it's in use. An idle item is purged
+// with reason IDLETIMEOUT, either when it is next requested (in which case Get
+// treats it as a miss) or when it is the least recently used item. A timeout
+// of 0 means the item never expires for lack of use, regardless of the
+// default idle timeout of the cache.
+//
+// This is independent of the time to live of the item: it expires at
+// whichever comes first.
+func (c *Cache) SetWithIdleTimeout(id string, p Cacheable, timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	c.setPrepared(id, p, func(e *cacheEntry) {
+		e.idleTimeout = timeout
+		e.lastAccess = c.clock.Now()
+	})
+}
+
+// TrySet stores an item in cache, like Set, but returns ErrTooLarge instead of
+// storing an item which can never fit in the cache. In that case OnPurge is not
+// called; the item was never cached.
+func (c *Cache) TrySet(id string, p Cacheable) error {
+	return c.trySet(id, p, inheritTTL)
+}
+
+func (c *Cache) trySet(id string, p Cacheable, ttl time.Duration) error {
 	if p == nil {
 		panic("Cacheable value must not be nil")
 	}
 	c.lock.Lock()
-	defer c.lock.Unlock()
-	directSet(c, id, p)
+	defer c.unlock()
+	return directSet(c, id, p, ttl)
+}
+
+// setPrepared stores an item like Set, after letting prepare fill in any extra
+// fields of its entry
+func (c *Cache) setPrepared(id string, p Cacheable, prepare func(e *cacheEntry)) {
+	if p == nil {
+		panic("Cacheable value must not be nil")
+	}
+	err := func() error {
+		c.lock.Lock()
+		defer c.unlock()
+		e, err := newEntry(c, id, p, inheritTTL)
+		if err != nil {
+			return err
+		}
+		prepare(e)
+		insertEntry(c, e)
+		return nil
+	}()
+	if err == ErrTooLarge {
+		if pe := rejectEntry(c, id, p); pe != nil {
+			panic(pe)
+		}
+	}
 }
 
 var ErrNotFound = errors.New("Key not found in cache")
 
+// ErrTooLarge is returned when storing an element whose size exceeds either
+// the maximum size of the cache or the maximum size of a single element.
+var ErrTooLarge = errors.New("Element too large for cache")
+
 // Get fetches an element from the cache.
 //
 // Updates the cache to mark this element as least recently used. If no element
 // is found for this id, a registered onmiss handler will be called.
 func (c *Cache) Get(id string) (Cacheable, error) {
+	val, err := get(c, id)
+	return handOut(c, val), err
+}
+
+// get is Get without copying the result
+func get(c *Cache, id string) (Cacheable, error) {
+	val, err, found, l, leader := lookup(c, id)
+	switch {
+	case found:
+		return val, err
+	case !leader:
+		// Somebody else is already on it
+		<-l.done
+		return l.val, l.err
+	}
+	// We don't want to lock the entire cache while handling the cache miss
+	return handleCacheMiss(c, id, l)
+}
+
+// lookup fetches an element from the cache and marks it as used. If there is
+// no such element, returns the load to wait for, or to perform if leader.
+func lookup(c *Cache, id string) (val Cacheable, err error, found bool, l *pendingLoad, leader bool) {
 	// A Get still modifies the cache in an LRU, so we need a write lock
 	c.lock.Lock()
-	// WARNING!! No deferred Unlock! Do not panic!
+	defer c.unlock()
 	e, ok := c.entries[id]
+	if ok {
+		if why, dead := obsolete(c, e); dead {
+			purgeEntry(c, e, why)
+			ok = false
+		}
+	}
 	if !ok {
-		// We don't want to lock the entire cache while handling the cache miss
-		c.lock.Unlock()
-		return handleCacheMiss(c, id)
+		if c.countStats {
+			c.stats.Misses++
+			if ns := namespaceOf(c, id); ns != nil {
+				ns.stats.Misses++
+			}
+		}
+		if c.purgePanic != nil {
+			// Purging the old entry panicked, which unlock is about to raise
+			// again: nobody would be around to perform the load
+			return nil, nil, false, nil, false
+		}
+		l, leader = startLoad(c, id)
+		return nil, nil, false, l, leader
 	}
-	defer c.lock.Unlock()
 
-	if e.younger == nil {
-		// I'm already the fresh kid on the block
-		return e.payload, nil
+	if e.err != nil {
+		if c.countStats {
+			c.stats.NegativeHits++
+			if e.ns != nil {
+				e.ns.stats.NegativeHits++
+			}
+		}
+		return nil, e.err, true, nil, false
+	}
+	if c.countStats {
+		c.stats.Hits++
+		if e.ns != nil {
+			e.ns.stats.Hits++
+		}
+	}
+	maybeRefresh(c, e)
+	touchEntry(c, e)
+	return e.payload, nil, true, nil, false
+}
+
+// touchEntry marks an entry as most recently used
+func touchEntry(c *Cache, e *cacheEntry) {
+	if e.idleTimeout > 0 {
+		e.lastAccess = c.clock.Now()
+	}
+	if c.policy == FIFO || e.size == 0 || e.younger == nil {
+		// I'm already the fresh kid on the block (or don't care)
+		return
 	}
 	// Put element at the start of the LRU list
 	if e.older != nil {
@@ -279,20 +985,21 @@ func (c *Cache) Get(id string) (Cacheable, error) {
 	c.mostRU = e        // I'm the newest one now
 	e.younger = nil     // nobody's younger than me
 	e.older.younger = e //
-
-	return e.payload, nil
+	if e.ns != nil {
+		nsUnlinkEntry(e.ns, e)
+		nsLinkEntry(c, e.ns, e)
+	}
+	return
 }
 
 func (c *Cache) Delete(id string) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	defer c.unlock()
 
+	invalidateLoad(c, id)
 	e, ok := c.entries[id]
 	if ok {
-		safeOnPurge(e.payload, EXPLICITDELETE)
-		if getSize(e.payload) != 0 {
-			removeEntry(c, e)
-		}
+		purgeEntry(c, e, EXPLICITDELETE)
 	}
 	return
 }
@@ -316,14 +1023,21 @@ func (c *Cache) Delete(id string) {
 // To remove a previously set OnMiss handler, call OnMiss(nil).
 //
 // Return (nil, nil) to indicate the specific key could not be found. It will
-// be treated as a Get() to an unknown key without an OnMiss handler set.
+// be treated as a Get() to an unknown key without an OnMiss handler set. To
+// avoid calling OnMiss over and over for the same unknown key, see
+// Config.NegativeTTL.
 //
 // The synchronization lock which controls access to the entire cache is
 // released before calling this function. The benefit is that a long running
-// OnMiss handler call won't block the cache. The downside is that calling Get
-// concurrently with the same key, before the first OnMiss call returns, will
-// invoke another OnMiss call; the last one to return will have its value stored
-// in the cache. To avoid this, wrap the OnMiss handler in a NoConcurrentDupes.
+// OnMiss handler call won't block the cache. Concurrent Gets for the same key,
+// before the first OnMiss call returns, wait for that call and share its
+// result. If the key is Set or Deleted while OnMiss is running, its result is
+// still returned from Get but not stored in the cache.
+//
+// To call OnMiss for every concurrent Get instead, see
+// Config.ConcurrentMisses. In that case the last call to return will have its
+// value stored in the cache. To avoid this, wrap the OnMiss handler in a
+// NoConcurrentDupes.
 func (c *Cache) OnMiss(f OnMissHandler) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -344,17 +1058,104 @@ func (c *Cache) OnMiss(f OnMissHandler) {
 // Can be changed at any point during the cache's lifetime.
 func (c *Cache) MaxSize(i int64) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	defer c.unlock()
 	c.maxSize = i
 	trimCache(c)
 }
 
+// MaxEntries updates the maximum number of elements in the cache.
+//
+// This limit is enforced alongside the one set by MaxSize: whichever is
+// exceeded first causes the least recently used elements to be purged with
+// reason CACHEFULL. It is mostly useful when cached elements report wildly
+// varying sizes, where a flood of tiny elements could otherwise grow the cache
+// without bound. Elements of size 0 are never purged and do not count towards
+// this limit. To remove the limit altogether set it to 0, which is the default.
+//
+// Can be changed at any point during the cache's lifetime.
+func (c *Cache) MaxEntries(i int64) {
+	c.lock.Lock()
+	defer c.unlock()
+	c.maxEntries = i
+	trimCache(c)
+}
+
+// MaxEntrySize limits the size of a single element.
+//
+// Elements larger than this are never stored (see Set and TrySet), which
+// prevents one large object from pushing everything else out of the cache.
+// This is an absolute size: it stays the same when MaxSize changes. To limit
+// elements to a fraction of the cache instead, see MaxEntryFraction. Elements
+// larger than the maximum size of the cache itself are always rejected, even
+// without this limit. Set to 0 to remove the limit, which is the default.
+//
+// Panics if the limit is negative, or exceeds the current maximum size of the
+// cache. Changing this limit does not affect elements which are already
+// cached.
+func (c *Cache) MaxEntrySize(i int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if i < 0 {
+		panic("MaxEntrySize must not be negative")
+	}
+	if c.maxSize > 0 && i > c.maxSize {
+		panic("MaxEntrySize exceeds MaxSize")
+	}
+	c.maxEntrySize = i
+}
+
+// MaxEntryFraction limits the size of a single element to a fraction of the
+// maximum size of the cache, e.g. 0.1 for one tenth. Unlike MaxEntrySize, the
+// limit follows MaxSize when that changes. It has no effect on a cache without
+// a maximum size. Set to 0 to remove the limit, which is the default.
+//
+// Panics unless the fraction is in [0, 1]. Changing this limit does not affect
+// elements which are already cached.
+func (c *Cache) MaxEntryFraction(f float64) {
+	if !(f >= 0 && f <= 1) {
+		panic("MaxEntryFraction must be in [0, 1]")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxEntryFraction = f
+}
+
 func (c *Cache) Size() int64 {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	return c.size
 }
 
+// Stats is a snapshot of the usage statistics of a cache. Counters are only
+// kept for caches created with Config.Stats set; Size and Entries are always
+// accurate.
+type Stats struct {
+	// Get calls answered from cache
+	Hits int64
+	// Get calls for an unknown (or expired) key
+	Misses int64
+	// Get calls answered by a remembered OnMiss miss or error, see
+	// Config.NegativeTTL
+	NegativeHits int64
+	// Elements purged with reason CACHEFULL
+	Evictions int64
+	// Elements purged with reason EXPIRED
+	Expirations int64
+	// Current size and number of elements, as per MaxSize and MaxEntries
+	Size    int64
+	Entries int64
+}
+
+// Stats returns a snapshot of the usage statistics of this cache.
+func (c *Cache) Stats() Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	s := c.stats
+	s.Size = c.size
+	s.Entries = c.count
+	return s
+}
+
 // Close is an obsolete explicit closer method.
 //
 // Kept around for backwards compatibility, but not necessary anymore.
@@ -362,7 +1163,8 @@ func (c *Cache) Close() error {
 	return nil
 }
 
-// Create and initialize a new cache, ready for use.
+// Create and initialize a new cache, ready for use. For more configuration
+// options, see NewWithConfig and NewWithOptions.
 func New(maxsize int64) *Cache {
 	var mem Cache
 	c := &mem
@@ -387,6 +1189,12 @@ func Set(id string, c Cacheable) {
 	return
 }
 
+// Put an object in the shared cache, or return ErrTooLarge if it doesn't fit.
+// See Cache.TrySet.
+func TrySet(id string, c Cacheable) error {
+	return sharedCache.TrySet(id, c)
+}
+
 // Delete an item from the shared cache.
 func Delete(id string) {
 	sharedCache.Delete(id)
@@ -399,3 +1207,9 @@ func MaxSize(size int64) {
 	sharedCache.MaxSize(size)
 	return
 }
+
+// Limit the number of elements in the shared cache. See Cache.MaxEntries.
+func MaxEntries(n int64) {
+	sharedCache.MaxEntries(n)
+	return
+}
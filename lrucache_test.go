@@ -12,6 +12,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
 )
 
 type varsize int
@@ -71,7 +73,7 @@ func TestOnPurge_2(t *testing.T) {
 }
 
 // Just test filling a cache with a type that does not implement NotifyPurge
-func TestsafeOnPurge(t *testing.T) {
+func TestSafeOnPurge(t *testing.T) {
 	c := New(1)
 	defer c.Close()
 	i := varsize(1)
@@ -289,6 +291,84 @@ func TestOnMissConcurrentGetGet(t *testing.T) {
 	checkDLL(t, c)
 }
 
+// Test that concurrent Gets for the same missing key share one OnMiss call
+func TestOnMissCoalesce(t *testing.T) {
+	const n = 10
+	c, err := NewWithConfig(Config{Stats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan bool)
+	calls := counter()
+	c.OnMiss(func(id string) (Cacheable, error) {
+		calls()
+		<-release
+		return id, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Get("foo"); v != "foo" || err != nil {
+				t.Error("Unexpected result:", v, err)
+			}
+		}()
+	}
+	// Every Get registers its miss before waiting
+	for c.Stats().Misses != n {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+	if count := calls() - 1; count != 1 {
+		t.Errorf("OnMiss called too often (%d times)", count)
+	}
+
+	checkDLL(t, c)
+}
+
+// Test that a Set or Delete during OnMiss is not overwritten by its result
+func TestOnMissStale(t *testing.T) {
+	c := New(10)
+	defer c.Close()
+	ch := make(chan string)
+	c.OnMiss(func(id string) (Cacheable, error) {
+		ch <- ""
+		return <-ch, nil
+	})
+	get := func() {
+		if v, err := c.Get("foo"); v != "loaded" || err != nil {
+			t.Error("Unexpected result from Get during Set:", v, err)
+		}
+		ch <- ""
+	}
+	go get()
+	<-ch
+	c.Set("foo", "set")
+	ch <- "loaded"
+	<-ch
+	if v, err := c.Get("foo"); v != "set" || err != nil {
+		t.Error("Set during OnMiss was overwritten:", v, err)
+	}
+	c.Delete("foo")
+	go get()
+	<-ch
+	c.Set("foo", "set")
+	c.Delete("foo")
+	ch <- "loaded"
+	<-ch
+	go func() {
+		<-ch
+		ch <- "reloaded"
+	}()
+	if v, err := c.Get("foo"); v != "reloaded" || err != nil {
+		t.Error("Delete during OnMiss was overwritten:", v, err)
+	}
+
+	checkDLL(t, c)
+}
+
 func TestZeroSize(t *testing.T) {
 	c := New(2)
 	defer c.Close()
@@ -310,6 +390,278 @@ func TestZeroSize(t *testing.T) {
 	checkDLL(t, c)
 }
 
+func TestMaxEntries(t *testing.T) {
+	c := New(0)
+	defer c.Close()
+	c.MaxEntries(3)
+	for i := 0; i < 5; i++ {
+		c.Set(strconv.Itoa(i), varsize(1))
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(strconv.Itoa(i)); err != ErrNotFound {
+			t.Errorf("Expected %d to be purged", i)
+		}
+	}
+	for i := 2; i < 5; i++ {
+		if _, err := c.Get(strconv.Itoa(i)); err != nil {
+			t.Errorf("Expected %d to be cached", i)
+		}
+	}
+	// Both limits apply, whichever is hit first
+	c.MaxSize(20)
+	c.Set("big", varsize(18))
+	if c.Size() != 20 {
+		t.Errorf("Unexpected size: %d", c.Size())
+	}
+	// Lowering the limit at runtime trims the cache immediately
+	c.MaxEntries(1)
+	if _, err := c.Get("big"); err != nil {
+		t.Error("Expected most recently used element to survive")
+	}
+	if c.Size() != 18 {
+		t.Errorf("Unexpected size: %d", c.Size())
+	}
+	// Size 0 elements don't count
+	c.Set("empty", varsize(0))
+	if _, err := c.Get("big"); err != nil {
+		t.Error("Size 0 element counted towards max entries")
+	}
+
+	checkDLL(t, c)
+}
+
+func TestTooLarge(t *testing.T) {
+	c := New(10)
+	defer c.Close()
+	var x purgeable
+	c.Set("x", &x)
+	c.Set("a", varsize(5))
+	if err := c.TrySet("a", varsize(11)); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge from TrySet, got:", err)
+	}
+	if x.purged {
+		t.Error("Oversized element flushed the cache")
+	}
+	if v, err := c.Get("a"); err != nil || v != varsize(5) {
+		t.Error("Oversized element replaced existing element:", v, err)
+	}
+	var big bigpurgeable
+	c.Set("big", &big)
+	if !big.purged || big.why != CACHEFULL {
+		t.Error("Oversized element passed to Set was not purged")
+	}
+	if _, err := c.Get("big"); err != ErrNotFound {
+		t.Error("Oversized element was stored")
+	}
+	c.MaxEntrySize(3)
+	if err := c.TrySet("b", varsize(4)); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge for element over MaxEntrySize, got:", err)
+	}
+	if err := c.TrySet("b", varsize(3)); err != nil {
+		t.Error("Unexpected error storing element within limits:", err)
+	}
+	if c.Size() != 9 {
+		t.Errorf("Unexpected size: %d", c.Size())
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected panic for MaxEntrySize over MaxSize")
+			}
+		}()
+		c.MaxEntrySize(11)
+	}()
+
+	checkDLL(t, c)
+}
+
+func TestTooLargeListeners(t *testing.T) {
+	var purged []string
+	c, err := NewWithConfig(Config{
+		MaxSize: 10,
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			if why != CACHEFULL {
+				t.Error("Unexpected purge reason:", why)
+			}
+			purged = append(purged, id)
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", varsize(11))
+	c.SetWithTags("b", varsize(11), "t")
+	c.GetOrSet("c", varsize(11))
+	if len(purged) != 3 || purged[0] != "a" || purged[1] != "b" || purged[2] != "c" {
+		t.Error("Listeners not told about oversized elements:", purged)
+	}
+	if err := c.TrySet("d", varsize(11)); err != ErrTooLarge || len(purged) != 3 {
+		t.Error("TrySet should not purge rejected element:", err, purged)
+	}
+}
+
+func TestMaxEntryFraction(t *testing.T) {
+	c, err := NewWithOptions(WithMaxSize(10), WithMaxEntryFraction(0.3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.TrySet("a", varsize(4)); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge for element over fraction, got:", err)
+	}
+	if err := c.TrySet("a", varsize(3)); err != nil {
+		t.Error("Unexpected error storing element within fraction:", err)
+	}
+	// Follows the maximum size
+	c.MaxSize(20)
+	if err := c.TrySet("b", varsize(6)); err != nil {
+		t.Error("Fraction did not follow MaxSize:", err)
+	}
+}
+
+type bigpurgeable struct {
+	purgeable
+}
+
+func (x *bigpurgeable) Size() int64 {
+	return 1000
+}
+
+func TestNegativeCaching(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	myerr := errors.New("some error")
+	calls := 0
+	c, err := NewWithConfig(Config{
+		Clock:        clock,
+		NegativeTTL:  time.Minute,
+		ErrorTTL:     time.Second,
+		NegativeSize: 2,
+		Stats:        true,
+		OnMiss: func(id string) (Cacheable, error) {
+			calls++
+			if id == "error" {
+				return nil, myerr
+			}
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get("missing"); err != ErrNotFound {
+			t.Error("Expected ErrNotFound, got:", err)
+		}
+		if _, err := c.Get("error"); err != myerr {
+			t.Error("Expected error from OnMiss, got:", err)
+		}
+	}
+	if calls != 2 {
+		t.Error("Unexpected number of OnMiss calls:", calls)
+	}
+	if c.Size() != 4 {
+		t.Error("Unexpected size:", c.Size())
+	}
+	s := c.Stats()
+	if s.Misses != 2 || s.NegativeHits != 4 || s.Hits != 0 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	clock.Advance(time.Second)
+	c.Get("missing")
+	c.Get("error")
+	if calls != 3 {
+		t.Error("Remembered error did not expire:", calls)
+	}
+	// Set overwrites a remembered miss
+	c.Set("missing", 123)
+	if v, err := c.Get("missing"); err != nil || v != 123 {
+		t.Error("Set did not overwrite remembered miss:", v, err)
+	}
+
+	checkDLL(t, c)
+}
+
+type token struct {
+	n       int
+	expires time.Time
+}
+
+func (x *token) ExpiresAt() time.Time {
+	return x.expires
+}
+
+type revocable struct {
+	revoked bool
+}
+
+func (x *revocable) Valid() bool {
+	return !x.revoked
+}
+
+func TestExpirer(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	var purges []PurgeReason
+	loads := 0
+	c, err := NewWithConfig(Config{
+		Clock: clock,
+		OnMiss: func(id string) (Cacheable, error) {
+			loads++
+			return &token{n: loads, expires: clock.Now().Add(time.Minute)}, nil
+		},
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			purges = append(purges, why)
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get("tok"); v.(*token).n != 1 {
+		t.Fatal("Unexpected token:", v)
+	}
+	clock.Advance(59 * time.Second)
+	if v, _ := c.Get("tok"); v.(*token).n != 1 {
+		t.Error("Token reloaded before it expired:", v)
+	}
+	clock.Advance(time.Second)
+	if v, _ := c.Get("tok"); v.(*token).n != 2 {
+		t.Error("Expired token not reloaded:", v)
+	}
+	if len(purges) != 1 || purges[0] != EXPIRED {
+		t.Error("Unexpected purges:", purges)
+	}
+	// Zero means never
+	c.Set("forever", &token{})
+	clock.Advance(time.Hour)
+	if _, err := c.Get("forever"); err != nil {
+		t.Error("Token without expiry time expired:", err)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	var purges []PurgeReason
+	c, err := NewWithConfig(Config{
+		OnMiss: func(id string) (Cacheable, error) {
+			return &revocable{}, nil
+		},
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			purges = append(purges, why)
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := c.Get("x")
+	if w, _ := c.Get("x"); w != v {
+		t.Fatal("Valid element not served from cache")
+	}
+	v.(*revocable).revoked = true
+	if w, _ := c.Get("x"); w == v {
+		t.Error("Invalid element served from cache")
+	}
+	if len(purges) != 1 || purges[0] != INVALID {
+		t.Error("Unexpected purges:", purges)
+	}
+}
+
 func checkDLL(t *testing.T, c *Cache) {
 	if c.mostRU == nil && c.leastRU == nil {
 		return
@@ -0,0 +1,121 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+// Helpers for testing code which uses lrucache.
+package lrucachetest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeClock is a clock which only moves when told to. It implements
+// lrucache.Clock, and is safe for concurrent use.
+//
+// Use it to test time dependent behaviour without sleeping:
+//
+//	clock := lrucachetest.NewFakeClock(time.Now())
+//	c, _ := lrucache.NewWithOptions(
+//	    lrucache.WithClock(clock),
+//	    lrucache.WithDefaultTTL(time.Minute),
+//	)
+//	c.Set("foo", 123)
+//	clock.Advance(time.Minute)
+//	c.Get("foo") // ErrNotFound
+type FakeClock struct {
+	lock sync.Mutex
+	// Signalled whenever a timer is added
+	cond   sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	when time.Time
+	f    func()
+}
+
+// NewFakeClock creates a fake clock, set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond.L = &c.lock
+	return c
+}
+
+// Now returns the current time of the fake clock.
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f to be called when the clock is advanced past d from
+// now. Unlike time.AfterFunc, f is called synchronously from Advance.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTimer{when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.remove(t)
+	}
+}
+
+// remove a pending timer, reporting whether it was still pending
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, p := range c.timers {
+		if p == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d, triggering all timers which are due,
+// in order. While a timer is triggered, the clock reads that timer's deadline.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].when.Before(c.timers[j].when)
+		})
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		// Timers are free to use the clock
+		c.lock.Unlock()
+		t.f()
+		c.lock.Lock()
+	}
+	c.now = end
+	c.lock.Unlock()
+}
+
+// Pending returns the number of timers waiting to be triggered.
+func (c *FakeClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until at least n timers are pending. Useful to make sure a
+// goroutine is waiting on the clock before advancing it.
+func (c *FakeClock) BlockUntil(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucachetest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	var fired []time.Duration
+	record := func() {
+		fired = append(fired, c.Now().Sub(start))
+	}
+	c.AfterFunc(3*time.Second, record)
+	c.AfterFunc(1*time.Second, record)
+	stop := c.AfterFunc(2*time.Second, record)
+	if !stop() {
+		t.Error("Expected pending timer to be stopped")
+	}
+	if stop() {
+		t.Error("Stopped timer twice")
+	}
+	c.Advance(2 * time.Second)
+	if len(fired) != 1 || fired[0] != time.Second {
+		t.Error("Unexpected timers fired:", fired)
+	}
+	if got := c.Now().Sub(start); got != 2*time.Second {
+		t.Error("Unexpected time after Advance:", got)
+	}
+	if c.Pending() != 1 {
+		t.Error("Unexpected number of pending timers:", c.Pending())
+	}
+	c.Advance(time.Hour)
+	if len(fired) != 2 || fired[1] != 3*time.Second {
+		t.Error("Unexpected timers fired:", fired)
+	}
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	c := NewFakeClock(time.Unix(0, 0))
+	done := make(chan bool)
+	go func() {
+		ch := make(chan bool)
+		c.AfterFunc(time.Minute, func() { close(ch) })
+		<-ch
+		done <- true
+	}()
+	c.BlockUntil(1)
+	c.Advance(time.Minute)
+	<-done
+}
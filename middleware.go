@@ -0,0 +1,175 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"log"
+	"time"
+)
+
+// Middleware adds behaviour to an OnMiss handler by wrapping it.
+type Middleware func(OnMissHandler) OnMissHandler
+
+// Chain wraps an OnMiss handler in a list of middlewares. The first middleware
+// is the outermost one: calls pass through the middlewares in the order they
+// are listed, before reaching h. So this:
+//
+//	c.OnMiss(lrucache.Chain(load,
+//	    lrucache.Deduplicated(),
+//	    lrucache.Throttled(8),
+//	    lrucache.Retried(lrucache.RetryPolicy{}),
+//	))
+//
+// is the same as:
+//
+//	dedup, _ := lrucache.NoConcurrentDupes(
+//	    lrucache.ThrottleConcurrency(
+//	        lrucache.Retry(load, lrucache.RetryPolicy{}),
+//	        8))
+//	c.OnMiss(dedup)
+func Chain(h OnMissHandler, mws ...Middleware) OnMissHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Deduplicated is the middleware form of NoConcurrentDupes. It can't be
+// closed, but there's no need to: it holds no resources while idle.
+func Deduplicated() Middleware {
+	return func(f OnMissHandler) OnMissHandler {
+		var g Group
+		return func(key string) (Cacheable, error) {
+			val, err, _ := g.Do(key, func() (Cacheable, error) {
+				return f(key)
+			})
+			return val, err
+		}
+	}
+}
+
+// Throttled is the middleware form of ThrottleConcurrency.
+func Throttled(maxconcurrent uint) Middleware {
+	return func(f OnMissHandler) OnMissHandler {
+		return ThrottleConcurrency(f, maxconcurrent)
+	}
+}
+
+// ThrottledByClass is the middleware form of ThrottleByClass.
+func ThrottledByClass(opts ClassThrottleOptions) Middleware {
+	return func(f OnMissHandler) OnMissHandler {
+		return ThrottleByClass(f, opts)
+	}
+}
+
+// ThrottledBy is the middleware form of Throttle.Wrap.
+func ThrottledBy(t *Throttle, priority func(key string) int) Middleware {
+	return func(f OnMissHandler) OnMissHandler {
+		return t.Wrap(f, priority)
+	}
+}
+
+// RateLimited is the middleware form of RateLimit.
+func RateLimited(rps float64, burst int) Middleware {
+	return RateLimitedWithOptions(RateLimitOptions{Rate: rps, Burst: burst})
+}
+
+// RateLimitedWithOptions is the middleware form of RateLimitWithOptions.
+func RateLimitedWithOptions(opts RateLimitOptions) Middleware {
+	return func(f OnMissHandler) OnMissHandler {
+		return RateLimitWithOptions(f, opts)
+	}
+}
+
+// CircuitBroken is the middleware form of CircuitBreaker.
+func CircuitBroken(opts CircuitBreakerOptions) Middleware {
+	return func(f OnMissHandler) OnMissHandler {
+		return CircuitBreaker(f, opts)
+	}
+}
+
+// Retried is the middleware form of Retry.
+func Retried(policy RetryPolicy) Middleware {
+	return func(f OnMissHandler) OnMissHandler {
+		return Retry(f, policy)
+	}
+}
+
+// TimedOut is the middleware form of WithTimeout.
+func TimedOut(d time.Duration) Middleware {
+	return TimedOutWithOptions(TimeoutOptions{After: d})
+}
+
+// TimedOutWithOptions is the middleware form of TimeoutWithOptions.
+func TimedOutWithOptions(opts TimeoutOptions) Middleware {
+	return func(f OnMissHandler) OnMissHandler {
+		return TimeoutWithOptions(f, opts)
+	}
+}
+
+// MeasureOptions configures the LoggedWithOptions and MeasuredWithOptions
+// middlewares.
+type MeasureOptions struct {
+	// Source of time, nil for the system clock
+	Clock Clock
+}
+
+// Logged logs every call, with its duration and outcome.
+func Logged(logger *log.Logger) Middleware {
+	return LoggedWithOptions(logger, MeasureOptions{})
+}
+
+// LoggedWithOptions is Logged with additional settings.
+func LoggedWithOptions(logger *log.Logger, opts MeasureOptions) Middleware {
+	return MeasuredWithOptions(func(key string, d time.Duration, err error) {
+		if err != nil {
+			logger.Printf("Loading %q failed after %v: %v", key, d, err)
+		} else {
+			logger.Printf("Loaded %q in %v", key, d)
+		}
+	}, opts)
+}
+
+// Traced calls start before every call, and the function it returns after it.
+// Intended for hooking up a tracing library, e.g.:
+//
+//	lrucache.Traced(func(key string) func(lrucache.Cacheable, error) {
+//	    span := tracer.StartSpan("load " + key)
+//	    return func(val lrucache.Cacheable, err error) {
+//	        span.Finish()
+//	    }
+//	})
+func Traced(start func(key string) func(val Cacheable, err error)) Middleware {
+	return func(f OnMissHandler) OnMissHandler {
+		return func(key string) (Cacheable, error) {
+			finish := start(key)
+			val, err := f(key)
+			finish(val, err)
+			return val, err
+		}
+	}
+}
+
+// Measured reports the duration and outcome of every call to observe.
+// Intended for hooking up a metrics library.
+func Measured(observe func(key string, d time.Duration, err error)) Middleware {
+	return MeasuredWithOptions(observe, MeasureOptions{})
+}
+
+// MeasuredWithOptions is Measured with additional settings.
+func MeasuredWithOptions(observe func(key string, d time.Duration, err error), opts MeasureOptions) Middleware {
+	clock := opts.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	return func(f OnMissHandler) OnMissHandler {
+		return func(key string) (Cacheable, error) {
+			start := clock.Now()
+			val, err := f(key)
+			observe(key, clock.Now().Sub(start), err)
+			return val, err
+		}
+	}
+}
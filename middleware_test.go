@@ -0,0 +1,135 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func TestChainOrder(t *testing.T) {
+	var trace []string
+	marker := func(name string) Middleware {
+		return func(f OnMissHandler) OnMissHandler {
+			return func(key string) (Cacheable, error) {
+				trace = append(trace, "enter "+name)
+				val, err := f(key)
+				trace = append(trace, "leave "+name)
+				return val, err
+			}
+		}
+	}
+	h := Chain(func(key string) (Cacheable, error) {
+		trace = append(trace, "handler")
+		return key, nil
+	}, marker("a"), marker("b"), marker("c"))
+	if v, err := h("foo"); v != "foo" || err != nil {
+		t.Error("Unexpected result:", v, err)
+	}
+	expected := "enter a,enter b,enter c,handler,leave c,leave b,leave a"
+	if got := strings.Join(trace, ","); got != expected {
+		t.Error("Unexpected order:", got)
+	}
+	if v, _ := Chain(func(key string) (Cacheable, error) { return 1, nil })("foo"); v != 1 {
+		t.Error("Empty chain changed result:", v)
+	}
+}
+
+// Retrying inside a circuit breaker counts one failure per call, outside it
+// counts one failure per attempt
+func TestChainOrderSemantics(t *testing.T) {
+	myerr := errors.New("down")
+	calls := 0
+	failing := func(key string) (Cacheable, error) {
+		calls++
+		return nil, myerr
+	}
+	retry := Retried(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Nanosecond})
+	breaker := func() Middleware {
+		return CircuitBroken(CircuitBreakerOptions{Threshold: 3})
+	}
+	h := Chain(failing, breaker(), retry)
+	h("foo")
+	h("foo")
+	if calls != 6 {
+		t.Error("Unexpected number of calls with retry inside breaker:", calls)
+	}
+	calls = 0
+	h = Chain(failing, retry, breaker())
+	h("foo")
+	h("foo")
+	if calls != 3 {
+		t.Error("Unexpected number of calls with breaker inside retry:", calls)
+	}
+}
+
+func TestLoggedTracedMeasured(t *testing.T) {
+	var buf bytes.Buffer
+	var traced, measured []string
+	h := Chain(func(key string) (Cacheable, error) {
+		if key == "bad" {
+			return nil, errors.New("bad key")
+		}
+		return key, nil
+	},
+		Logged(log.New(&buf, "", 0)),
+		Traced(func(key string) func(Cacheable, error) {
+			traced = append(traced, "start "+key)
+			return func(val Cacheable, err error) {
+				traced = append(traced, "finish "+key)
+			}
+		}),
+		Measured(func(key string, d time.Duration, err error) {
+			measured = append(measured, key)
+		}),
+	)
+	h("good")
+	h("bad")
+	if out := buf.String(); !strings.Contains(out, `Loaded "good"`) || !strings.Contains(out, "bad key") {
+		t.Error("Unexpected log output:", out)
+	}
+	if got := strings.Join(traced, ","); got != "start good,finish good,start bad,finish bad" {
+		t.Error("Unexpected trace:", got)
+	}
+	if len(measured) != 2 {
+		t.Error("Unexpected measurements:", measured)
+	}
+}
+
+func TestMiddlewareWithOptions(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	var buf bytes.Buffer
+	var measured time.Duration
+	h := Chain(func(key string) (Cacheable, error) {
+		clock.Advance(3 * time.Second)
+		return key, nil
+	},
+		LoggedWithOptions(log.New(&buf, "", 0), MeasureOptions{Clock: clock}),
+		MeasuredWithOptions(func(key string, d time.Duration, err error) {
+			measured = d
+		}, MeasureOptions{Clock: clock}),
+		RateLimitedWithOptions(RateLimitOptions{Rate: 1, Burst: 1, Clock: clock}),
+	)
+	h("a")
+	if measured != 3*time.Second {
+		t.Error("Unexpected measured duration:", measured)
+	}
+	if out := buf.String(); !strings.Contains(out, "in 3s") {
+		t.Error("Unexpected log output:", out)
+	}
+	// The limiter runs on the same clock: 3s later, a token is available
+	if _, err := h("b"); err != nil {
+		t.Error("Unexpected rate limit:", err)
+	}
+	if _, err := h("c"); err != nil {
+		t.Error("Unexpected rate limit:", err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"strings"
+	"time"
+)
+
+// NamespaceSeparator separates the name of a namespace from the id of an
+// element in it, in the id it is stored under in the cache.
+const NamespaceSeparator = ":"
+
+// Namespace is a view of the elements in a cache whose id starts with its
+// name, followed by NamespaceSeparator. Its methods prefix ids transparently.
+// E.g. Set("bob", x) on namespace "users" stores x as "users:bob" in the
+// underlying cache, and the OnMiss handler of that cache is called with
+// "users:bob".
+//
+// A namespace can have a quota on the total size of its elements. Once it
+// exceeds that, its own least recently used elements are purged with reason
+// CACHEFULL, even if there is room left in the cache. Otherwise elements are
+// purged from the cache as a whole, regardless of namespace. This gives every
+// tenant of a shared cache a fair share, without setting aside memory for
+// those who don't use it.
+type Namespace struct {
+	c      *Cache
+	name   string
+	prefix string
+	quota  int64
+	size   int64
+	count  int64
+	// Usage statistics of this namespace only
+	stats Stats
+	// See Namespace.Bump
+	generation uint64
+	// LRU list of the elements in this namespace, a subset of that of the
+	// cache in the same order. See cacheEntry.nsOlder and nsYounger.
+	leastRU *cacheEntry
+	mostRU  *cacheEntry
+}
+
+// Namespace returns the namespace with this name, creating it if it doesn't
+// exist yet. The quota limits the total size of its elements (see MaxSize);
+// set it to 0 for no limit other than that of the cache. Calling Namespace
+// again with a different quota changes it.
+//
+// Elements already in the cache under an id in this namespace become part of
+// it. Panics if the name contains NamespaceSeparator, or the quota is
+// negative.
+func (c *Cache) Namespace(name string, quota int64) *Namespace {
+	if quota < 0 {
+		panic("Namespace quota must not be negative")
+	}
+	c.lock.Lock()
+	defer c.unlock()
+	ns := getNamespace(c, name)
+	ns.quota = quota
+	checkQuota(c, ns)
+	trimCache(c)
+	return ns
+}
+
+// getNamespace returns the namespace with this name, creating it without a
+// quota if it doesn't exist yet
+func getNamespace(c *Cache, name string) *Namespace {
+	if strings.Contains(name, NamespaceSeparator) {
+		panic("Namespace name must not contain " + NamespaceSeparator)
+	}
+	ns, ok := c.namespaces[name]
+	if !ok {
+		ns = &Namespace{c: c, name: name, prefix: name + NamespaceSeparator}
+		c.namespaces[name] = ns
+		adoptEntries(c, ns)
+	}
+	return ns
+}
+
+// adoptEntries moves the entries already in a new namespace into it
+func adoptEntries(c *Cache, ns *Namespace) {
+	for id, e := range c.entries {
+		if strings.HasPrefix(id, ns.prefix) {
+			e.ns = ns
+		}
+	}
+	// Oldest first, to end up in the same order
+	for e := c.leastRU; e != nil; e = e.younger {
+		if e.ns == ns {
+			nsLinkEntry(c, ns, e)
+		}
+	}
+	return
+}
+
+// namespaceOf returns the namespace an id belongs to, if any
+func namespaceOf(c *Cache, id string) *Namespace {
+	if len(c.namespaces) == 0 {
+		return nil
+	}
+	i := strings.Index(id, NamespaceSeparator)
+	if i < 0 {
+		return nil
+	}
+	return c.namespaces[id[:i]]
+}
+
+// checkQuota remembers to trim a namespace if it exceeds its quota
+func checkQuota(c *Cache, ns *Namespace) {
+	if ns.quota > 0 && ns.size > ns.quota {
+		c.overQuota[ns] = struct{}{}
+	}
+	return
+}
+
+// nsLinkEntry puts an entry in the LRU list of its namespace as the most
+// recently used one. Does not trim the cache.
+func nsLinkEntry(c *Cache, ns *Namespace, e *cacheEntry) {
+	if ns.leastRU == nil {
+		ns.leastRU = e
+	} else {
+		ns.mostRU.nsYounger = e
+		e.nsOlder = ns.mostRU
+	}
+	ns.mostRU = e
+	ns.size += e.size
+	ns.count++
+	checkQuota(c, ns)
+	return
+}
+
+// nsUnlinkEntry takes an entry out of the LRU list of its namespace
+func nsUnlinkEntry(ns *Namespace, e *cacheEntry) {
+	if e.nsOlder == nil {
+		ns.leastRU = e.nsYounger
+	} else {
+		e.nsOlder.nsYounger = e.nsYounger
+	}
+	if e.nsYounger == nil {
+		ns.mostRU = e.nsOlder
+	} else {
+		e.nsYounger.nsOlder = e.nsOlder
+	}
+	e.nsOlder = nil
+	e.nsYounger = nil
+	ns.size -= e.size
+	ns.count--
+	return
+}
+
+// Name of this namespace
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// Get fetches an element from the namespace. See Cache.Get.
+func (ns *Namespace) Get(id string) (Cacheable, error) {
+	return ns.c.Get(ns.prefix + id)
+}
+
+// Set stores an element in the namespace. See Cache.Set.
+func (ns *Namespace) Set(id string, p Cacheable) {
+	ns.c.Set(ns.prefix+id, p)
+}
+
+// SetWithTTL stores an element in the namespace, which expires after the given
+// duration. See Cache.SetWithTTL.
+func (ns *Namespace) SetWithTTL(id string, p Cacheable, ttl time.Duration) {
+	ns.c.SetWithTTL(ns.prefix+id, p, ttl)
+}
+
+// TrySet stores an element in the namespace, or returns ErrTooLarge if it
+// can never fit in the cache or in the quota of the namespace. See
+// Cache.TrySet.
+func (ns *Namespace) TrySet(id string, p Cacheable) error {
+	return ns.c.TrySet(ns.prefix+id, p)
+}
+
+// Delete an element from the namespace. See Cache.Delete.
+func (ns *Namespace) Delete(id string) {
+	ns.c.Delete(ns.prefix + id)
+}
+
+// Stats returns a snapshot of the usage statistics of this namespace. See
+// Cache.Stats.
+func (ns *Namespace) Stats() Stats {
+	ns.c.lock.RLock()
+	defer ns.c.lock.RUnlock()
+	s := ns.stats
+	s.Size = ns.size
+	s.Entries = ns.count
+	return s
+}
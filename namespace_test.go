@@ -0,0 +1,137 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"testing"
+)
+
+// checkNamespace verifies the LRU list of a namespace against that of its
+// cache
+func checkNamespace(t *testing.T, c *Cache, ns *Namespace) {
+	var want []*cacheEntry
+	var size int64
+	for e := c.leastRU; e != nil; e = e.younger {
+		if e.ns == ns {
+			want = append(want, e)
+			size += e.size
+		}
+	}
+	var got []*cacheEntry
+	for e := ns.leastRU; e != nil; e = e.nsYounger {
+		got = append(got, e)
+	}
+	if len(got) != len(want) || int64(len(got)) != ns.count || size != ns.size {
+		t.Fatalf("namespace %s inconsistent: %d entries, want %d, count %d, size %d, want %d",
+			ns.name, len(got), len(want), ns.count, ns.size, size)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("namespace %s inconsistent: order differs from cache at %d", ns.name, i)
+		}
+	}
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	var purged []string
+	c, err := NewWithConfig(Config{
+		MaxSize: 10,
+		Stats:   true,
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			if why != CACHEFULL {
+				t.Error("Unexpected purge reason:", why)
+			}
+			purged = append(purged, id)
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := c.Namespace("a", 3)
+	b := c.Namespace("b", 0)
+	b.Set("1", 1)
+	a.Set("1", 1)
+	a.Set("2", 1)
+	a.Set("3", 1)
+	a.Get("1")
+	// Over quota: evict a's least recently used, not the cache's
+	a.Set("4", 1)
+	if len(purged) != 1 || purged[0] != "a:2" {
+		t.Fatal("Expected a:2 to be evicted, got", purged)
+	}
+	checkNamespace(t, c, a)
+	checkNamespace(t, c, b)
+	if err := a.TrySet("big", varsize(4)); err != ErrTooLarge {
+		t.Error("Expected element over quota to be rejected, got", err)
+	}
+	// Fill up the cache through b, which has no quota
+	for _, id := range []string{"2", "3", "4", "5", "6", "7"} {
+		b.Set(id, 1)
+	}
+	if len(purged) != 1 {
+		t.Fatal("Unexpected evictions:", purged)
+	}
+	b.Set("8", 1)
+	if len(purged) != 2 || purged[1] != "b:1" {
+		t.Fatal("Expected global LRU to be evicted, got", purged)
+	}
+	checkNamespace(t, c, a)
+	checkNamespace(t, c, b)
+	checkDLL(t, c)
+	s := a.Stats()
+	if s.Size != 3 || s.Entries != 3 || s.Evictions != 1 || s.Hits != 1 {
+		t.Errorf("Unexpected stats for a: %+v", s)
+	}
+	if s := b.Stats(); s.Size != 7 || s.Evictions != 1 {
+		t.Errorf("Unexpected stats for b: %+v", s)
+	}
+	if s := c.Stats(); s.Size != 10 || s.Evictions != 2 {
+		t.Errorf("Unexpected stats for cache: %+v", s)
+	}
+}
+
+func TestNamespaceIDs(t *testing.T) {
+	c := New(0)
+	c.Set("a:old", 1)
+	c.Set("a:older", 2)
+	c.Set("ab:x", 3)
+	a := c.Namespace("a", 0)
+	if c.Namespace("a", 1) != a {
+		t.Fatal("Expected the same namespace")
+	}
+	// Lowering the quota trims existing elements
+	if _, err := a.Get("old"); err != ErrNotFound {
+		t.Error("Expected a:old to be evicted, got", err)
+	}
+	if v, err := a.Get("older"); err != nil || v != 2 {
+		t.Error("Unexpected value from namespace:", v, err)
+	}
+	a.Set("x", 4)
+	if v, err := c.Get("a:x"); err != nil || v != 4 {
+		t.Error("Namespace did not prefix id:", v, err)
+	}
+	if v, err := c.Get("ab:x"); err != nil || v != 3 {
+		t.Error("Unexpected value outside namespace:", v, err)
+	}
+	a.Delete("x")
+	if _, err := c.Get("a:x"); err != ErrNotFound {
+		t.Error("Expected a:x to be deleted, got", err)
+	}
+	checkNamespace(t, c, a)
+}
+
+func TestNamespaceUpdate(t *testing.T) {
+	c := New(0)
+	a := c.Namespace("a", 10)
+	a.Set("1", varsize(2))
+	a.Set("2", varsize(2))
+	if err := c.UpdateWithOptions("a:2", varsize(9), UpdateOptions{KeepRecency: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Get("1"); err != ErrNotFound {
+		t.Error("Expected a:1 to be evicted after growing a:2, got", err)
+	}
+	checkNamespace(t, c, a)
+}
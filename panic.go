@@ -0,0 +1,56 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is what a panic in user code called by the cache, or by one of
+// its wrappers, is converted to. That includes OnMiss handlers, OnPurge methods
+// and purge listeners.
+//
+// A panic in an OnMiss handler is returned as an error to every caller waiting
+// for its result. A panic in OnPurge or a purge listener is raised again, as
+// a *PanicError, from the cache method which caused the purge, once the cache
+// is back in a consistent state and its lock is released.
+type PanicError struct {
+	// The value passed to panic()
+	Value interface{}
+	// Stack trace of the goroutine which panicked, at the time it panicked
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n\n%s", p.Value, p.Stack)
+}
+
+// Unwrap returns the panic value if it is an error.
+func (p *PanicError) Unwrap() error {
+	if err, ok := p.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// catchPanic calls f and returns any panic as a *PanicError
+func catchPanic(f func()) (p *PanicError) {
+	defer func() {
+		if r := recover(); r != nil {
+			p = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	f()
+	return nil
+}
+
+// protect calls f and returns any panic as an error
+func protect(f func() (Cacheable, error)) (val Cacheable, err error) {
+	if p := catchPanic(func() { val, err = f() }); p != nil {
+		return nil, p
+	}
+	return val, err
+}
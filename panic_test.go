@@ -0,0 +1,135 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+type panicky struct{}
+
+func (panicky) OnPurge(why PurgeReason) {
+	panic("OnPurge")
+}
+
+func expectPanicError(t *testing.T, f func()) {
+	defer func() {
+		r := recover()
+		if p, ok := r.(*PanicError); !ok || p.Value != "OnPurge" {
+			t.Errorf("Expected *PanicError, got: %#v", r)
+		}
+	}()
+	f()
+}
+
+func TestPanicOnMiss(t *testing.T) {
+	const n = 5
+	c, err := NewWithConfig(Config{Stats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan bool)
+	myerr := errors.New("my error")
+	c.OnMiss(func(id string) (Cacheable, error) {
+		<-release
+		panic(myerr)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Get("foo")
+			p, ok := err.(*PanicError)
+			if !ok || len(p.Stack) == 0 {
+				t.Errorf("Expected *PanicError, got: %#v", err)
+			}
+			if !errors.Is(err, myerr) {
+				t.Error("PanicError does not wrap panic value")
+			}
+		}()
+	}
+	for c.Stats().Misses != n {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+	// Cache is still usable
+	c.Set("foo", 1)
+	if v, err := c.Get("foo"); v != 1 || err != nil {
+		t.Error("Unexpected result after panic:", v, err)
+	}
+
+	checkDLL(t, c)
+}
+
+func TestPanicOnPurge(t *testing.T) {
+	c := New(2)
+	defer c.Close()
+	c.Set("a", panicky{})
+	expectPanicError(t, func() { c.Delete("a") })
+	c.Set("a", panicky{})
+	c.Set("b", 1)
+	expectPanicError(t, func() { c.Set("c", 1) })
+	if _, err := c.Get("a"); err != ErrNotFound {
+		t.Error("Element not purged despite panic")
+	}
+	if c.Size() != 2 {
+		t.Error("Unexpected size after panic:", c.Size())
+	}
+
+	checkDLL(t, c)
+}
+
+// A Get whose expired element panics on purge must not leave a load behind for
+// others to wait for
+func TestPanicOnPurgeGet(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	c, err := NewWithConfig(Config{
+		Clock: clock,
+		OnMiss: func(id string) (Cacheable, error) {
+			return 1, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWithTTL("a", panicky{}, time.Second)
+	clock.Advance(time.Second)
+	expectPanicError(t, func() { c.Get("a") })
+	done := make(chan bool)
+	go func() {
+		c.Get("a")
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get hangs after a panic in OnPurge")
+	}
+	if len(c.loads) != 0 {
+		t.Error("Load left behind:", c.loads)
+	}
+}
+
+func TestPanicGroup(t *testing.T) {
+	wrapped, quit := NoConcurrentDupes(func(id string) (Cacheable, error) {
+		panic("OnMiss")
+	})
+	defer func() { quit <- true }()
+	if _, err := wrapped("foo"); err == nil {
+		t.Error("Expected error from panicking function")
+	}
+	// Nobody is stuck on the panicked call
+	if _, err := wrapped("foo"); err == nil {
+		t.Error("Expected error from panicking function")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("Rate limit exceeded")
+
+// tokenBucket is a rate limiter allowing bursts of up to burst calls, refilled
+// at rate tokens per second
+type tokenBucket struct {
+	lock   sync.Mutex
+	clock  Clock
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take a token from the bucket, if there is one
+func (b *tokenBucket) take() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.clock.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimitOptions configures a RateLimitWithOptions wrapper.
+type RateLimitOptions struct {
+	// Calls per second, on average. Must be positive.
+	Rate float64
+	// Maximum number of calls in a burst. Must be at least 1.
+	Burst int
+	// Source of time, nil for the system clock
+	Clock Clock
+}
+
+// Wrapper function that limits the rate of calls to f to rps calls per second
+// on average, with bursts of up to burst calls. Calls over the limit fail
+// immediately with ErrRateLimited, without calling f. Intended for wrapping
+// OnMiss handlers, to protect a backend from a flood of cache misses.
+//
+// Panics unless rps is positive and burst at least 1: either would reject
+// (almost) every call forever.
+func RateLimit(f OnMissHandler, rps float64, burst int) OnMissHandler {
+	return RateLimitWithOptions(f, RateLimitOptions{Rate: rps, Burst: burst})
+}
+
+// RateLimitWithOptions is RateLimit with all its settings in a struct.
+func RateLimitWithOptions(f OnMissHandler, opts RateLimitOptions) OnMissHandler {
+	if !(opts.Rate > 0) {
+		panic("Rate limit must be positive")
+	}
+	if opts.Burst < 1 {
+		panic("Rate limit burst must be at least 1")
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	b := &tokenBucket{
+		clock:  clock,
+		rate:   opts.Rate,
+		burst:  float64(opts.Burst),
+		tokens: float64(opts.Burst),
+		last:   clock.Now(),
+	}
+	return func(key string) (Cacheable, error) {
+		if !b.take() {
+			return nil, ErrRateLimited
+		}
+		return f(key)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func TestRateLimit(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	calls := counter()
+	f := RateLimitWithOptions(func(id string) (Cacheable, error) {
+		calls()
+		return id, nil
+	}, RateLimitOptions{Rate: 2, Burst: 3, Clock: clock})
+	try := func(n int) (ok int) {
+		for i := 0; i < n; i++ {
+			if _, err := f("foo"); err == nil {
+				ok++
+			} else if err != ErrRateLimited {
+				t.Fatal("Unexpected error:", err)
+			}
+		}
+		return
+	}
+	if ok := try(5); ok != 3 {
+		t.Error("Expected burst of 3 calls, got:", ok)
+	}
+	clock.Advance(time.Second)
+	if ok := try(5); ok != 2 {
+		t.Error("Expected 2 calls after a second, got:", ok)
+	}
+	// Tokens don't accumulate beyond the burst
+	clock.Advance(time.Hour)
+	if ok := try(5); ok != 3 {
+		t.Error("Expected burst of 3 calls, got:", ok)
+	}
+	if n := calls() - 1; n != 8 {
+		t.Error("Unexpected number of calls to wrapped function:", n)
+	}
+}
+
+func TestRateLimitInvalid(t *testing.T) {
+	f := func(string) (Cacheable, error) { return 1, nil }
+	for _, args := range []struct {
+		rps   float64
+		burst int
+	}{{0, 1}, {-1, 1}, {1, 0}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected panic for rps %v, burst %d", args.rps, args.burst)
+				}
+			}()
+			RateLimit(f, args.rps, args.burst)
+		}()
+	}
+}
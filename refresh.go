@@ -0,0 +1,63 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+// maybeRefresh starts refreshing a requested entry in the background, if it is
+// due and there is a worker available
+func maybeRefresh(c *Cache, e *cacheEntry) {
+	if e.refreshAt.IsZero() || e.refreshing || c.onMiss == nil {
+		return
+	}
+	if c.refreshing >= c.refreshWorkers || c.clock.Now().Before(e.refreshAt) {
+		return
+	}
+	c.refreshing++
+	e.refreshing = true
+	go refresh(c, e, e.version, c.onMiss)
+	return
+}
+
+// refresh reloads an entry through OnMiss, and replaces it with the result
+// unless it has been changed, replaced or removed in the mean time.
+//
+// The payload is replaced in place, like Update: the old one is not purged, so
+// nobody is notified, and elements depending on it are kept. Refreshing an
+// element doesn't count as using it.
+func refresh(c *Cache, e *cacheEntry, version uint64, onmiss OnMissHandler) {
+	val, err := protect(func() (Cacheable, error) { return onmiss(e.id) })
+	if err == nil && val == nil {
+		err = ErrNotFound
+	}
+	if err == nil && c.cloneOnSet {
+		val = cloneValue(c, val)
+	}
+	c.lock.Lock()
+	// Even if the result is discarded because the entry was changed in the
+	// mean time, the entry is no longer being refreshed: try again next time
+	e.refreshing = false
+	current := c.entries[e.id] == e && e.version == version && !staleGeneration(c, e)
+	hook := c.onRefreshError
+	if current && err == nil {
+		size := getSize(val)
+		if fits(c, e.id, size) {
+			checkMutation(c, e)
+			replacePayload(c, e, val, size, true)
+			renewExpiry(c, e)
+			trimCache(c)
+			dropPanic(c)
+		} else {
+			err = ErrTooLarge
+		}
+	}
+	c.lock.Unlock()
+	if current && err != nil && hook != nil {
+		// Nobody to raise a panic to
+		catchPanic(func() { hook(e.id, err) })
+	}
+	// Only free the worker once it's really done
+	c.lock.Lock()
+	c.refreshing--
+	c.lock.Unlock()
+}
@@ -0,0 +1,179 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func waitForRefresh(c *Cache) {
+	for {
+		c.lock.RLock()
+		n := c.refreshing
+		c.lock.RUnlock()
+		if n == 0 {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	myerr := errors.New("backend down")
+	version := 0
+	var fail bool
+	var refreshErrors []error
+	c, err := NewWithConfig(Config{
+		Clock:        clock,
+		DefaultTTL:   10 * time.Second,
+		RefreshAhead: 0.5,
+		Stats:        true,
+		OnMiss: func(id string) (Cacheable, error) {
+			if fail {
+				return nil, myerr
+			}
+			version++
+			return version, nil
+		},
+		OnRefreshError: func(id string, err error) {
+			refreshErrors = append(refreshErrors, err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Get("foo")
+	clock.Advance(4 * time.Second)
+	if v, _ := c.Get("foo"); v != 1 {
+		t.Error("Unexpected value:", v)
+	}
+	waitForRefresh(c)
+	if version != 1 {
+		t.Error("Refreshed too early")
+	}
+	clock.Advance(time.Second)
+	if v, _ := c.Get("foo"); v != 1 {
+		t.Error("Refresh did not happen in the background:", v)
+	}
+	waitForRefresh(c)
+	// The refreshed value has a fresh TTL
+	clock.Advance(9 * time.Second)
+	if v, _ := c.Get("foo"); v != 2 {
+		t.Error("Unexpected value after refresh:", v)
+	}
+	waitForRefresh(c)
+	if s := c.Stats(); s.Misses != 1 {
+		t.Error("Unexpected number of misses:", s.Misses)
+	}
+	// Failure keeps the old value
+	clock.Advance(5 * time.Second)
+	fail = true
+	if v, _ := c.Get("foo"); v != 3 {
+		t.Error("Unexpected value:", v)
+	}
+	waitForRefresh(c)
+	if len(refreshErrors) != 1 || refreshErrors[0] != myerr {
+		t.Error("Refresh error not reported:", refreshErrors)
+	}
+	if v, err := c.Get("foo"); v != 3 || err != nil {
+		t.Error("Failed refresh dropped old value:", v, err)
+	}
+	waitForRefresh(c)
+
+	checkDLL(t, c)
+}
+
+// Refreshing replaces an element in place, without purging it
+func TestRefreshInPlace(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	var purged []string
+	version := 0
+	c, err := NewWithConfig(Config{
+		Clock:        clock,
+		RefreshAhead: 0.5,
+		OnMiss: func(id string) (Cacheable, error) {
+			version++
+			return &purgeable{}, nil
+		},
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			purged = append(purged, id)
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWithTTL("data", &purgeable{}, 10*time.Second)
+	c.SetWithDeps("page", 1, "data")
+	old, _ := c.Get("data")
+	clock.Advance(5 * time.Second)
+	c.Get("data")
+	waitForRefresh(c)
+	if version != 1 {
+		t.Fatal("Expected a refresh, got", version)
+	}
+	if v, _ := c.Get("data"); v == old {
+		t.Error("Value not refreshed")
+	}
+	if old.(*purgeable).purged || len(purged) != 0 {
+		t.Error("Refresh purged elements:", purged)
+	}
+	if _, err := c.Get("page"); err != nil {
+		t.Error("Refresh purged dependent:", err)
+	}
+	// The refreshed value has a fresh TTL
+	clock.Advance(9 * time.Second)
+	if _, err := c.Get("data"); err != nil {
+		t.Error("Refreshed value expired early:", err)
+	}
+	checkDLL(t, c)
+}
+
+func TestRefreshAfterUpdate(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	started := make(chan bool, 2)
+	release := make(chan bool)
+	c, err := NewWithConfig(Config{
+		Clock:        clock,
+		RefreshAhead: 0.5,
+		OnMiss: func(id string) (Cacheable, error) {
+			started <- true
+			<-release
+			return "refreshed", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWithTTL("foo", "old", 10*time.Second)
+	clock.Advance(5 * time.Second)
+	c.Get("foo")
+	<-started
+	if err := c.Update("foo", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	release <- true
+	waitForRefresh(c)
+	if v, _ := c.Get("foo"); v != "updated" {
+		t.Error("Refresh overwrote updated value:", v)
+	}
+	// The discarded refresh must not keep the element from refreshing again
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No refresh after a discarded one")
+	}
+	release <- true
+	waitForRefresh(c)
+	if v, _ := c.Get("foo"); v != "refreshed" {
+		t.Error("Unexpected value after second refresh:", v)
+	}
+	checkDLL(t, c)
+}
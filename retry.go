@@ -0,0 +1,105 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures a Retry wrapper. The zero value is a sane default.
+type RetryPolicy struct {
+	// Maximum number of calls, including the first one. Defaults to 3.
+	MaxAttempts int
+	// Delay before the first retry. Defaults to 100ms.
+	InitialBackoff time.Duration
+	// Upper limit to the delay between retries, 0 for none.
+	MaxBackoff time.Duration
+	// The delay is multiplied by this after every retry. Defaults to 2.
+	Multiplier float64
+	// Randomize every delay by up to this fraction of it, in either direction.
+	// E.g. with 0.1, a delay of 1s becomes anything between 0.9s and 1.1s.
+	Jitter float64
+	// Decides whether an error is worth retrying. By default, every error is
+	// except a *PanicError or a *CircuitOpenError, or one wrapping either.
+	Retryable func(error) bool
+	// No more calls are made once this context is done. The error of the last
+	// call is returned, or the error of the context if no call was made yet.
+	Context context.Context
+	// Source of time, nil for the system clock
+	Clock Clock
+}
+
+func defaultRetryable(err error) bool {
+	var pe *PanicError
+	var coe *CircuitOpenError
+	return !errors.As(err, &pe) && !errors.As(err, &coe)
+}
+
+// sleep waits for d to pass on the clock, or for the context to be done.
+// Returns false in the latter case.
+func sleep(ctx context.Context, clock Clock, d time.Duration) bool {
+	ch := make(chan struct{})
+	stop := clock.AfterFunc(d, func() { close(ch) })
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		stop()
+		return false
+	}
+}
+
+// Wrapper function that calls f again when it fails, with exponential backoff
+// between calls. Intended for wrapping OnMiss handlers which talk to a flaky
+// backend. A (nil, nil) "not found" result is not a failure.
+//
+// Composes with the other wrappers. Wrap the result in NoConcurrentDupes to
+// retry only once for concurrent calls with the same key. Wrap it in
+// ThrottleConcurrency to hold on to a slot while backing off, or put
+// ThrottleConcurrency inside it to release the slot between attempts.
+func Retry(f OnMissHandler, policy RetryPolicy) OnMissHandler {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = 100 * time.Millisecond
+	}
+	if policy.Multiplier <= 0 {
+		policy.Multiplier = 2
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = defaultRetryable
+	}
+	if policy.Context == nil {
+		policy.Context = context.Background()
+	}
+	if policy.Clock == nil {
+		policy.Clock = realClock{}
+	}
+	return func(key string) (Cacheable, error) {
+		ctx := policy.Context
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		backoff := float64(policy.InitialBackoff)
+		for attempt := 1; ; attempt++ {
+			val, err := f(key)
+			if err == nil || attempt >= policy.MaxAttempts || !policy.Retryable(err) {
+				return val, err
+			}
+			d := backoff * (1 + policy.Jitter*(2*rand.Float64()-1))
+			if policy.MaxBackoff > 0 && d > float64(policy.MaxBackoff) {
+				d = float64(policy.MaxBackoff)
+			}
+			if !sleep(ctx, policy.Clock, time.Duration(d)) {
+				return val, err
+			}
+			backoff *= policy.Multiplier
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func TestRetry(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := lrucachetest.NewFakeClock(start)
+	myerr := errors.New("flaky")
+	var attempts []time.Duration
+	f := Retry(func(id string) (Cacheable, error) {
+		attempts = append(attempts, clock.Now().Sub(start))
+		if len(attempts) < 4 {
+			return nil, myerr
+		}
+		return id, nil
+	}, RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     3 * time.Second,
+		Clock:          clock,
+	})
+	done := make(chan bool)
+	go func() {
+		if v, err := f("foo"); v != "foo" || err != nil {
+			t.Error("Unexpected result:", v, err)
+		}
+		done <- true
+	}()
+	// Second backoff is doubled, third is capped
+	for _, d := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		clock.BlockUntil(1)
+		clock.Advance(d)
+	}
+	<-done
+	expected := []time.Duration{0, time.Second, 3 * time.Second, 6 * time.Second}
+	if len(attempts) != len(expected) {
+		t.Fatal("Unexpected attempts:", attempts)
+	}
+	for i := range expected {
+		if attempts[i] != expected[i] {
+			t.Fatal("Unexpected attempts:", attempts)
+		}
+	}
+}
+
+func TestRetryGiveUp(t *testing.T) {
+	myerr := errors.New("permanent")
+	calls := 0
+	f := Retry(func(id string) (Cacheable, error) {
+		calls++
+		return nil, myerr
+	}, RetryPolicy{
+		InitialBackoff: time.Nanosecond,
+		Retryable:      func(err error) bool { return err != myerr },
+	})
+	if _, err := f("foo"); err != myerr || calls != 1 {
+		t.Error("Retried non-retryable error:", err, calls)
+	}
+	calls = 0
+	f = Retry(func(id string) (Cacheable, error) {
+		calls++
+		return nil, myerr
+	}, RetryPolicy{InitialBackoff: time.Nanosecond})
+	if _, err := f("foo"); err != myerr || calls != 3 {
+		t.Error("Unexpected number of attempts:", err, calls)
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	myerr := errors.New("flaky")
+	calls := 0
+	f := Retry(func(id string) (Cacheable, error) {
+		calls++
+		return nil, myerr
+	}, RetryPolicy{Context: ctx, Clock: clock})
+	done := make(chan bool)
+	go func() {
+		if _, err := f("foo"); err != myerr {
+			t.Error("Expected last error after cancel, got:", err)
+		}
+		done <- true
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	<-done
+	if calls != 1 {
+		t.Error("Unexpected number of attempts:", calls)
+	}
+	if _, err := f("foo"); err != context.Canceled {
+		t.Error("Expected context error, got:", err)
+	}
+}
+
+func TestRetryableWrapped(t *testing.T) {
+	wrapped := []error{
+		fmt.Errorf("loading: %w", &PanicError{Value: "boom"}),
+		fmt.Errorf("loading: %w", &CircuitOpenError{}),
+	}
+	for _, err := range wrapped {
+		if defaultRetryable(err) {
+			t.Error("Wrapped error considered retryable:", err)
+		}
+	}
+	if !defaultRetryable(errors.New("flaky")) {
+		t.Error("Plain error not considered retryable")
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"strings"
+)
+
+// indexEntry adds a freshly stored entry to the secondary indexes
+func indexEntry(c *Cache, e *cacheEntry) {
+	for _, tag := range e.tags {
+		ids, ok := c.tags[tag]
+		if !ok {
+			ids = map[string]struct{}{}
+			c.tags[tag] = ids
+		}
+		ids[e.id] = struct{}{}
+	}
+	for _, dep := range e.deps {
+		ids, ok := c.dependents[dep]
+		if !ok {
+			ids = map[string]struct{}{}
+			c.dependents[dep] = ids
+		}
+		ids[e.id] = struct{}{}
+	}
+	if c.keyIndex != nil {
+		c.keyIndex.insert(e.id)
+	}
+	return
+}
+
+// unindexEntry removes an entry from the secondary indexes
+func unindexEntry(c *Cache, e *cacheEntry) {
+	for _, tag := range e.tags {
+		ids := c.tags[tag]
+		delete(ids, e.id)
+		if len(ids) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+	for _, dep := range e.deps {
+		ids := c.dependents[dep]
+		delete(ids, e.id)
+		if len(ids) == 0 {
+			delete(c.dependents, dep)
+		}
+	}
+	if c.keyIndex != nil {
+		c.keyIndex.remove(e.id)
+	}
+	return
+}
+
+// SetWithTags stores an item in cache, like Set, labelled with a number of
+// tags. All items with a certain tag can be deleted at once using
+// InvalidateTag. E.g. tag every item belonging to a tenant with its id, and
+// invalidate that tag when the tenant changes its settings.
+func (c *Cache) SetWithTags(id string, p Cacheable, tags ...string) {
+	c.setPrepared(id, p, func(e *cacheEntry) {
+		e.tags = append([]string(nil), tags...)
+	})
+}
+
+// deleteIDs deletes a number of elements, as if by Delete, and returns how many
+// there were
+func deleteIDs(c *Cache, ids []string) int {
+	n := 0
+	for _, id := range ids {
+		invalidateLoad(c, id)
+		// Purging one element can (indirectly) purge another
+		if e, ok := c.entries[id]; ok {
+			purgeEntry(c, e, EXPLICITDELETE)
+			n++
+		}
+	}
+	return n
+}
+
+// InvalidateTag deletes every element with this tag, as if by Delete. Returns
+// the number of deleted elements.
+func (c *Cache) InvalidateTag(tag string) int {
+	c.lock.Lock()
+	defer c.unlock()
+	var ids []string
+	for id := range c.tags[tag] {
+		ids = append(ids, id)
+	}
+	return deleteIDs(c, ids)
+}
+
+// DeletePrefix deletes every element whose id starts with prefix, as if by
+// Delete. Returns the number of deleted elements.
+//
+// The first call builds an index of all ids in the cache, which is maintained
+// from then on. This costs some memory and a little time for every stored
+// element, but makes every DeletePrefix call proportional to the number of
+// elements it deletes rather than to the size of the cache.
+func (c *Cache) DeletePrefix(prefix string) int {
+	c.lock.Lock()
+	defer c.unlock()
+	if c.keyIndex == nil {
+		c.keyIndex = &keyTrie{}
+		for id := range c.entries {
+			c.keyIndex.insert(id)
+		}
+	}
+	return deleteIDs(c, c.keyIndex.withPrefix(prefix))
+}
+
+// keyTrie is a set of strings, indexed by their prefixes. It is a compressed
+// (radix) trie: every node is labelled with the substring leading up to it
+// from its parent, and a node which is not in the set has at least two
+// children, so there are never more nodes than twice the number of keys.
+type keyTrie struct {
+	label    string
+	children []*keyTrie
+	// Whether the string leading up to this node is in the set
+	present bool
+}
+
+// child returns the index of the child whose label starts with b, or -1. Labels
+// of siblings never share their first byte.
+func (t *keyTrie) child(b byte) int {
+	for i, c := range t.children {
+		if c.label[0] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *keyTrie) insert(key string) {
+	for key != "" {
+		i := t.child(key[0])
+		if i < 0 {
+			t.children = append(t.children, &keyTrie{label: key, present: true})
+			return
+		}
+		next := t.children[i]
+		n := commonPrefix(next.label, key)
+		if n < len(next.label) {
+			// Split the edge where key branches off
+			mid := &keyTrie{label: next.label[:n], children: []*keyTrie{next}}
+			next.label = next.label[n:]
+			t.children[i] = mid
+			next = mid
+		}
+		t = next
+		key = key[n:]
+	}
+	t.present = true
+}
+
+// remove a key, pruning the branches that leaves empty and merging nodes left
+// with a single child into it. Reports whether this node is now empty.
+func (t *keyTrie) remove(key string) bool {
+	if key == "" {
+		t.present = false
+	} else if i := t.child(key[0]); i >= 0 && strings.HasPrefix(key, t.children[i].label) {
+		next := t.children[i]
+		if next.remove(key[len(next.label):]) {
+			last := len(t.children) - 1
+			t.children[i] = t.children[last]
+			t.children[last] = nil
+			t.children = t.children[:last]
+		} else if !next.present && len(next.children) == 1 {
+			only := next.children[0]
+			only.label = next.label + only.label
+			t.children[i] = only
+		}
+	}
+	return !t.present && len(t.children) == 0
+}
+
+// withPrefix returns all keys starting with prefix
+func (t *keyTrie) withPrefix(prefix string) []string {
+	var key string
+	for key != prefix {
+		rest := prefix[len(key):]
+		i := t.child(rest[0])
+		if i < 0 {
+			return nil
+		}
+		t = t.children[i]
+		if !strings.HasPrefix(rest, t.label) && !strings.HasPrefix(t.label, rest) {
+			return nil
+		}
+		key += t.label
+		if len(key) > len(prefix) {
+			// The prefix ends halfway this node's label
+			break
+		}
+	}
+	var keys []string
+	t.collect(key, &keys)
+	return keys
+}
+
+func (t *keyTrie) collect(key string, keys *[]string) {
+	if t.present {
+		*keys = append(*keys, key)
+	}
+	for _, child := range t.children {
+		child.collect(key+child.label, keys)
+	}
+}
+
+// commonPrefix returns the length of the longest common prefix of a and b
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,175 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func TestInvalidateTag(t *testing.T) {
+	var purged []string
+	c, err := NewWithConfig(Config{
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			if why != EXPLICITDELETE {
+				t.Error("Unexpected purge reason:", why)
+			}
+			purged = append(purged, id)
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWithTags("a", 1, "x", "y")
+	c.SetWithTags("b", 2, "x")
+	c.SetWithTags("c", 3, "y")
+	c.Set("d", 4)
+	if n := c.InvalidateTag("x"); n != 2 {
+		t.Error("Expected 2 invalidated elements, got", n)
+	}
+	sort.Strings(purged)
+	if len(purged) != 2 || purged[0] != "a" || purged[1] != "b" {
+		t.Error("Unexpected purged elements:", purged)
+	}
+	if _, err := c.Get("c"); err != nil {
+		t.Error("Untagged element c was deleted:", err)
+	}
+	if _, err := c.Get("d"); err != nil {
+		t.Error("Untagged element d was deleted:", err)
+	}
+	if n := c.InvalidateTag("x"); n != 0 {
+		t.Error("Expected nothing left to invalidate, got", n)
+	}
+	if _, ok := c.tags["x"]; ok {
+		t.Error("Tag index leaked:", c.tags)
+	}
+	if ids := c.tags["y"]; len(ids) != 1 {
+		t.Error("Unexpected ids for tag y:", ids)
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	c := New(100)
+	c.Set("user:1", 1)
+	c.Set("user:2", 2)
+	c.Set("user", 3)
+	if n := c.DeletePrefix("user:"); n != 2 {
+		t.Error("Expected 2 deleted elements, got", n)
+	}
+	if _, err := c.Get("user"); err != nil {
+		t.Error("Element outside prefix was deleted:", err)
+	}
+	// The index is maintained after it's built
+	c.Set("user:3", 3)
+	c.Set("admin:1", 1)
+	if n := c.DeletePrefix("user"); n != 2 {
+		t.Error("Expected 2 deleted elements, got", n)
+	}
+	if n := c.DeletePrefix("nope"); n != 0 {
+		t.Error("Expected nothing deleted, got", n)
+	}
+	if n := c.DeletePrefix(""); n != 1 {
+		t.Error("Expected empty prefix to delete everything, got", n)
+	}
+	if len(c.keyIndex.children) != 0 || c.keyIndex.present {
+		t.Error("Key index leaked:", c.keyIndex.children)
+	}
+}
+
+// Indexes must be cleaned up however an element leaves the cache
+func TestIndexLeaks(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	c, err := NewWithConfig(Config{MaxEntries: 2, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.DeletePrefix("")
+	// Eviction
+	c.SetWithTags("a", 1, "t")
+	c.SetWithTags("b", 2, "t")
+	c.SetWithTags("c", 3, "t")
+	// Key collision: "c" loses its tag
+	c.Set("c", 4)
+	// Explicit delete
+	c.Delete("b")
+	// Expiry
+	c.SetWithTTL("d", 5, time.Second)
+	clock.Advance(2 * time.Second)
+	c.Get("d")
+	if len(c.tags) != 0 {
+		t.Error("Tag index leaked:", c.tags)
+	}
+	if ids := c.keyIndex.withPrefix(""); len(ids) != 1 || ids[0] != "c" {
+		t.Error("Key index leaked:", ids)
+	}
+}
+
+// checkTrie verifies that t is fully compressed, and returns its number of nodes
+func checkTrie(t *testing.T, n *keyTrie, root bool) int {
+	if !root && !n.present && len(n.children) < 2 {
+		t.Errorf("Uncompressed node %q with %d children", n.label, len(n.children))
+	}
+	seen := map[byte]bool{}
+	count := 1
+	for _, c := range n.children {
+		if c.label == "" || seen[c.label[0]] {
+			t.Errorf("Invalid child label %q", c.label)
+			continue
+		}
+		seen[c.label[0]] = true
+		count += checkTrie(t, c, false)
+	}
+	return count
+}
+
+func TestKeyTrie(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var trie keyTrie
+	keys := map[string]bool{}
+	randomKey := func() string {
+		b := make([]byte, r.Intn(6))
+		for i := range b {
+			b[i] = "abc"[r.Intn(3)]
+		}
+		return string(b)
+	}
+	for i := 0; i < 2000; i++ {
+		key := randomKey()
+		if r.Intn(3) == 0 {
+			trie.remove(key)
+			delete(keys, key)
+		} else {
+			trie.insert(key)
+			keys[key] = true
+		}
+		if n := checkTrie(t, &trie, true); n > 2*len(keys)+1 {
+			t.Fatalf("Trie of %d keys has %d nodes", len(keys), n)
+		}
+		prefix := randomKey()
+		var want []string
+		for k := range keys {
+			if strings.HasPrefix(k, prefix) {
+				want = append(want, k)
+			}
+		}
+		got := trie.withPrefix(prefix)
+		sort.Strings(want)
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(want, ",") || len(got) != len(want) {
+			t.Fatalf("Keys with prefix %q: expected %q, got %q", prefix, want, got)
+		}
+	}
+	for k := range keys {
+		trie.remove(k)
+	}
+	if len(trie.children) != 0 || trie.present {
+		t.Error("Trie not empty after removing all keys:", trie.children)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// ThrottleOptions configures a Throttle. The zero value is a throttle with an
+// unlimited queue and no timeout.
+type ThrottleOptions struct {
+	// Maximum number of callers waiting for a slot. Callers beyond that are
+	// rejected with a *ThrottleError. 0 for no limit.
+	MaxQueue int
+	// Maximum time to wait for a slot, after which the caller gets a
+	// *ThrottleError. 0 for no limit.
+	Timeout time.Duration
+	// Source of time, nil for the system clock
+	Clock Clock
+}
+
+// ThrottleError is returned when a Throttle refuses a call.
+type ThrottleError struct {
+	// True if the caller gave up waiting for a slot, false if it was rejected
+	// outright because the queue was full
+	Timeout bool
+}
+
+func (e *ThrottleError) Error() string {
+	if e.Timeout {
+		return "Timed out waiting for throttle"
+	}
+	return "Throttle queue is full"
+}
+
+// Throttle limits the number of concurrent calls, like ThrottleConcurrency,
+// but hands out free slots in order of priority, first come first served
+// within the same priority. Higher priorities go first.
+//
+// E.g. give interactive lookups priority 1 and background prefetches priority
+// 0, so a flood of prefetches never holds up an interactive lookup for longer
+// than it takes a single call to complete.
+type Throttle struct {
+	lock     sync.Mutex
+	max      int
+	opts     ThrottleOptions
+	inFlight int
+	queue    throttleQueue
+	// Tie breaker for equal priorities
+	seq uint64
+}
+
+type throttleWaiter struct {
+	priority int
+	seq      uint64
+	// Closed once this waiter is handed a slot
+	ready chan struct{}
+	// Position in the queue, -1 once it's out
+	index int
+}
+
+// throttleQueue is a heap of waiters, highest priority and then oldest first
+type throttleQueue []*throttleWaiter
+
+func (q throttleQueue) Len() int { return len(q) }
+
+func (q throttleQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q throttleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *throttleQueue) Push(x interface{}) {
+	w := x.(*throttleWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *throttleQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// NewThrottle creates a throttle allowing up to max concurrent calls. Panics
+// if max is not positive.
+func NewThrottle(max int, opts ThrottleOptions) *Throttle {
+	if max <= 0 {
+		panic("Throttle limit must be positive")
+	}
+	if opts.Clock == nil {
+		opts.Clock = realClock{}
+	}
+	return &Throttle{max: max, opts: opts}
+}
+
+// Acquire waits for a free slot. Once granted, the caller must call release
+// exactly once when done. Returns a *ThrottleError if the queue is full or the
+// caller times out.
+func (t *Throttle) Acquire(priority int) (release func(), err error) {
+	t.lock.Lock()
+	if t.inFlight < t.max && t.queue.Len() == 0 {
+		t.inFlight++
+		t.lock.Unlock()
+		return t.releaser(), nil
+	}
+	if t.opts.MaxQueue > 0 && t.queue.Len() >= t.opts.MaxQueue {
+		t.lock.Unlock()
+		return nil, &ThrottleError{}
+	}
+	w := &throttleWaiter{priority: priority, seq: t.seq, ready: make(chan struct{})}
+	t.seq++
+	heap.Push(&t.queue, w)
+	t.lock.Unlock()
+
+	var timeout chan struct{}
+	if t.opts.Timeout > 0 {
+		timeout = make(chan struct{})
+		stop := t.opts.Clock.AfterFunc(t.opts.Timeout, func() { close(timeout) })
+		defer stop()
+	}
+	select {
+	case <-w.ready:
+		return t.releaser(), nil
+	case <-timeout:
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if w.index < 0 {
+			// Handed a slot just in time
+			return t.releaser(), nil
+		}
+		heap.Remove(&t.queue, w.index)
+		return nil, &ThrottleError{Timeout: true}
+	}
+}
+
+// releaser returns a function which releases a slot, only the first time it's
+// called
+func (t *Throttle) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(t.release)
+	}
+}
+
+// release hands a slot to the next waiter, or frees it if there is none
+func (t *Throttle) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.queue.Len() == 0 {
+		t.inFlight--
+		return
+	}
+	w := heap.Pop(&t.queue).(*throttleWaiter)
+	close(w.ready)
+}
+
+// Do calls fn once a slot is free, or returns a *ThrottleError.
+func (t *Throttle) Do(priority int, fn func() (Cacheable, error)) (Cacheable, error) {
+	release, err := t.Acquire(priority)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return fn()
+}
+
+// Wrap returns a wrapper function which calls f through this throttle.
+// Intended for wrapping OnMiss handlers. The priority of every call is
+// determined from its key; if priority is nil, all calls have priority 0.
+func (t *Throttle) Wrap(f OnMissHandler, priority func(key string) int) OnMissHandler {
+	return func(key string) (Cacheable, error) {
+		p := 0
+		if priority != nil {
+			p = priority(key)
+		}
+		return t.Do(p, func() (Cacheable, error) {
+			return f(key)
+		})
+	}
+}
+
+// InFlight returns the number of calls holding a slot.
+func (t *Throttle) InFlight() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.inFlight
+}
+
+// Queued returns the number of calls waiting for a slot.
+func (t *Throttle) Queued() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.queue.Len()
+}
+
+// ClassThrottleOptions configures ThrottleByClass.
+type ClassThrottleOptions struct {
+	// Determines the class of a key, e.g. the tenant in "tenant:<id>:...".
+	Classify func(key string) string
+	// Maximum number of concurrent calls for specific classes
+	Limits map[string]int
+	// Maximum number of concurrent calls for classes not in Limits. 0 for no
+	// limit.
+	DefaultLimit int
+	// Maximum number of concurrent calls across all classes. 0 for no limit.
+	GlobalLimit int
+}
+
+// classThrottle is the throttle of a single class, kept around for as long as
+// anyone is using it
+type classThrottle struct {
+	t     *Throttle
+	users int
+}
+
+// Wrapper function that limits the number of concurrent calls to f per class
+// of keys, and optionally overall. Intended for wrapping OnMiss handlers, so
+// that one class of keys (e.g. one tenant) can't use up all the concurrency
+// and starve the others.
+//
+// A call first waits for a slot in its class, and only then for a slot in the
+// global limit. Calls waiting for their class therefore don't take global
+// slots from other classes.
+func ThrottleByClass(f OnMissHandler, opts ClassThrottleOptions) OnMissHandler {
+	var lock sync.Mutex
+	classes := map[string]*classThrottle{}
+	var global *Throttle
+	if opts.GlobalLimit > 0 {
+		global = NewThrottle(opts.GlobalLimit, ThrottleOptions{})
+	}
+	// join the throttle for this class, if it has a limit
+	join := func(class string) *classThrottle {
+		limit, ok := opts.Limits[class]
+		if !ok {
+			limit = opts.DefaultLimit
+		}
+		if limit <= 0 {
+			return nil
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		ct, ok := classes[class]
+		if !ok {
+			ct = &classThrottle{t: NewThrottle(limit, ThrottleOptions{})}
+			classes[class] = ct
+		}
+		ct.users++
+		return ct
+	}
+	leave := func(class string, ct *classThrottle) {
+		lock.Lock()
+		defer lock.Unlock()
+		ct.users--
+		if ct.users == 0 {
+			delete(classes, class)
+		}
+	}
+	return func(key string) (Cacheable, error) {
+		class := opts.Classify(key)
+		if ct := join(class); ct != nil {
+			defer leave(class, ct)
+			release, err := ct.t.Acquire(0)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+		}
+		if global != nil {
+			release, err := global.Acquire(0)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+		}
+		return f(key)
+	}
+}
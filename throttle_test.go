@@ -0,0 +1,183 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func waitForQueue(th *Throttle, n int) {
+	for th.Queued() != n {
+		runtime.Gosched()
+	}
+}
+
+func TestThrottlePriority(t *testing.T) {
+	th := NewThrottle(1, ThrottleOptions{})
+	release, err := th.Acquire(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	// Queue up in a known order
+	for i, p := range []int{0, 1, 0, 2, 1} {
+		i, p := i, p
+		wg.Add(1)
+		go th.Do(p, func() (Cacheable, error) {
+			lock.Lock()
+			order = append(order, p*10+i)
+			lock.Unlock()
+			wg.Done()
+			return nil, nil
+		})
+		waitForQueue(th, i+1)
+	}
+	if th.InFlight() != 1 {
+		t.Error("Unexpected number of calls in flight:", th.InFlight())
+	}
+	release()
+	// Releasing twice is harmless
+	release()
+	wg.Wait()
+	expected := []int{23, 11, 14, 0, 2}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatal("Unexpected order:", order)
+		}
+	}
+	if th.InFlight() != 0 || th.Queued() != 0 {
+		t.Error("Throttle not empty:", th.InFlight(), th.Queued())
+	}
+}
+
+func TestThrottleReject(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	th := NewThrottle(1, ThrottleOptions{MaxQueue: 1, Timeout: time.Second, Clock: clock})
+	release, _ := th.Acquire(0)
+	done := make(chan error)
+	go func() {
+		_, err := th.Acquire(0)
+		done <- err
+	}()
+	waitForQueue(th, 1)
+	if _, err := th.Acquire(5); err == nil {
+		t.Error("Expected full queue to reject call")
+	} else if te, ok := err.(*ThrottleError); !ok || te.Timeout {
+		t.Error("Expected *ThrottleError for full queue, got:", err)
+	}
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if te, ok := (<-done).(*ThrottleError); !ok || !te.Timeout {
+		t.Error("Expected timeout waiting for slot")
+	}
+	if th.Queued() != 0 {
+		t.Error("Timed out caller still queued")
+	}
+	release()
+	if th.InFlight() != 0 {
+		t.Error("Unexpected number of calls in flight:", th.InFlight())
+	}
+}
+
+func TestThrottleWrap(t *testing.T) {
+	var i, max int32
+	var lock sync.Mutex
+	f := NewThrottle(3, ThrottleOptions{}).Wrap(func(key string) (Cacheable, error) {
+		lock.Lock()
+		i++
+		max = maxInt32(max, i)
+		lock.Unlock()
+		time.Sleep(time.Millisecond)
+		lock.Lock()
+		i--
+		lock.Unlock()
+		return key, nil
+	}, nil)
+	var wg sync.WaitGroup
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := f("foo"); v != "foo" || err != nil {
+				t.Error("Unexpected result:", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if max != 3 {
+		t.Errorf("Unexpected maximum concurrency: %d (expected 3)", max)
+	}
+}
+
+func TestThrottleByClass(t *testing.T) {
+	var lock sync.Mutex
+	running := map[string]int{}
+	total := 0
+	release := make(chan bool)
+	started := make(chan string)
+	f := ThrottleByClass(func(key string) (Cacheable, error) {
+		class := key[:1]
+		lock.Lock()
+		running[class]++
+		total++
+		lock.Unlock()
+		started <- class
+		<-release
+		lock.Lock()
+		running[class]--
+		total--
+		lock.Unlock()
+		return key, nil
+	}, ClassThrottleOptions{
+		Classify:     func(key string) string { return key[:1] },
+		Limits:       map[string]int{"a": 2},
+		DefaultLimit: 1,
+		GlobalLimit:  4,
+	})
+	var wg sync.WaitGroup
+	for _, key := range []string{"a1", "a2", "a3", "a4", "b1", "b2", "c1", "d1"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			f(key)
+		}(key)
+	}
+	// The noisy class can't keep the others from starting
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		seen[<-started]++
+	}
+	lock.Lock()
+	if running["a"] > 2 || running["b"] > 1 || total != 4 {
+		t.Error("Limits exceeded:", running, total)
+	}
+	lock.Unlock()
+	if seen["a"] > 2 {
+		t.Error("Class exceeded its limit:", seen)
+	}
+	go func() {
+		for range started {
+		}
+	}()
+	close(release)
+	wg.Wait()
+	close(started)
+}
+
+func TestThrottleInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic for a limit of 0")
+		}
+	}()
+	NewThrottle(0, ThrottleOptions{})
+}
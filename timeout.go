@@ -0,0 +1,69 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimeoutError is returned by a WithTimeout wrapper when the wrapped function
+// takes too long.
+type TimeoutError struct {
+	Key   string
+	After time.Duration
+	// The call which timed out, which is done once its result is in. Every
+	// cache miss receiving this error shares it, see storeLate.
+	late *pendingLoad
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Loading %q timed out after %v", e.Key, e.After)
+}
+
+// TimeoutOptions configures a TimeoutWithOptions wrapper.
+type TimeoutOptions struct {
+	// How long to wait for the wrapped function
+	After time.Duration
+	// Source of time, nil for the system clock
+	Clock Clock
+}
+
+// Wrapper function that gives up waiting for f after d, returning a
+// *TimeoutError. Intended for wrapping OnMiss handlers, so a slow backend
+// doesn't block Get for too long.
+//
+// The call to f is not aborted, but continues in the background. If it is the
+// OnMiss handler of a cache, and it eventually succeeds, the cache stores its
+// result as if the call had been in time, so the next Get hits. Unless, that
+// is, the key was Set or Deleted in the mean time. Because of this, timeouts
+// are never remembered as errors (see Config.ErrorTTL).
+func WithTimeout(f OnMissHandler, d time.Duration) OnMissHandler {
+	return TimeoutWithOptions(f, TimeoutOptions{After: d})
+}
+
+// TimeoutWithOptions is WithTimeout with all its settings in a struct.
+func TimeoutWithOptions(f OnMissHandler, opts TimeoutOptions) OnMissHandler {
+	d, clock := opts.After, opts.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	return func(key string) (Cacheable, error) {
+		call := &pendingLoad{done: make(chan struct{})}
+		go func() {
+			call.val, call.err = protect(func() (Cacheable, error) { return f(key) })
+			close(call.done)
+		}()
+		timeout := make(chan struct{})
+		stop := clock.AfterFunc(d, func() { close(timeout) })
+		select {
+		case <-call.done:
+			stop()
+			return call.val, call.err
+		case <-timeout:
+			return nil, &TimeoutError{Key: key, After: d, late: call}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hraban/lrucache/lrucachetest"
+)
+
+func waitForLateLoads(c *Cache) {
+	for {
+		c.lock.RLock()
+		n := len(c.lateLoads)
+		c.lock.RUnlock()
+		if n == 0 {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	release := make(chan string)
+	c := New(10)
+	defer c.Close()
+	c.OnMiss(TimeoutWithOptions(func(id string) (Cacheable, error) {
+		if id == "slow" {
+			return <-release, nil
+		}
+		return id, nil
+	}, TimeoutOptions{After: time.Second, Clock: clock}))
+	if v, err := c.Get("fast"); v != "fast" || err != nil {
+		t.Error("Unexpected result:", v, err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := c.Get("slow")
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	err := <-done
+	if te, ok := err.(*TimeoutError); !ok || te.Key != "slow" {
+		t.Fatal("Expected *TimeoutError, got:", err)
+	}
+	// The late result ends up in the cache
+	release <- "late"
+	waitForLateLoads(c)
+	if v, err := c.Get("slow"); v != "late" || err != nil {
+		t.Error("Unexpected result after late load:", v, err)
+	}
+
+	checkDLL(t, c)
+}
+
+func TestWithTimeoutStale(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	release := make(chan string)
+	c := New(10)
+	defer c.Close()
+	c.OnMiss(TimeoutWithOptions(func(id string) (Cacheable, error) {
+		return <-release, nil
+	}, TimeoutOptions{After: time.Second, Clock: clock}))
+	done := make(chan bool)
+	go func() {
+		c.Get("slow")
+		done <- true
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	<-done
+	c.Set("slow", "set")
+	release <- "late"
+	waitForLateLoads(c)
+	if v, _ := c.Get("slow"); v != "set" {
+		t.Error("Late result overwrote Set:", v)
+	}
+}
+
+// A timed out call shared by concurrent misses is only waited for once
+func TestWithTimeoutShared(t *testing.T) {
+	clock := lrucachetest.NewFakeClock(time.Unix(1000, 0))
+	release := make(chan string)
+	slow := TimeoutWithOptions(func(id string) (Cacheable, error) {
+		return <-release, nil
+	}, TimeoutOptions{After: time.Second, Clock: clock})
+	var g Group
+	c, err := NewWithConfig(Config{
+		ConcurrentMisses: true,
+		OnMiss: func(id string) (Cacheable, error) {
+			val, err, _ := g.Do(id, func() (Cacheable, error) { return slow(id) })
+			return val, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.Get("slow")
+			done <- err
+		}()
+	}
+	// Wait for the second Get to join the call of the first
+	for {
+		g.lock.Lock()
+		gc := g.calls["slow"]
+		joined := gc != nil && gc.dups == 1
+		g.lock.Unlock()
+		if joined {
+			break
+		}
+		runtime.Gosched()
+	}
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if _, ok := (<-done).(*TimeoutError); !ok {
+			t.Fatal("Expected *TimeoutError")
+		}
+	}
+	release <- "late"
+	waitForLateLoads(c)
+	if v, err := c.Get("slow"); v != "late" || err != nil {
+		t.Error("Late result of shared call lost:", v, err)
+	}
+}
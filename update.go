@@ -0,0 +1,90 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+// UpdateOptions configures UpdateWithOptions.
+type UpdateOptions struct {
+	// Leave the element where it is in the LRU list, rather than marking it
+	// as used
+	KeepRecency bool
+	// Tell the replaced value about it: through OnReplace if it implements
+	// NotifyReplace, or else through OnPurge with reason REPLACED. Purge
+	// listeners are called with reason REPLACED.
+	Notify bool
+}
+
+// Update replaces the element stored under id in place, without notifying
+// anyone, and marks it as used. See UpdateWithOptions.
+func (c *Cache) Update(id string, p Cacheable) error {
+	return c.UpdateWithOptions(id, p, UpdateOptions{})
+}
+
+// UpdateWithOptions replaces the element stored under id in place. Unlike Set,
+// it does not purge the old value with reason KEYCOLLISION, and it keeps the
+// expiry time of the element. Elements depending on it are purged, as with
+// Set. The size of the cache is adjusted for the difference in size between
+// the old and the new value.
+//
+// Returns ErrNotFound if there is no element under id, or ErrTooLarge if the
+// new value can never fit in the cache. In either case, nothing is changed.
+func (c *Cache) UpdateWithOptions(id string, p Cacheable, opts UpdateOptions) error {
+	if p == nil {
+		panic("Cacheable value must not be nil")
+	}
+	if c.cloneOnSet {
+		p = cloneValue(c, p)
+	}
+	c.lock.Lock()
+	defer c.unlock()
+	e := liveEntry(c, id)
+	if e == nil {
+		return ErrNotFound
+	}
+	size := getSize(p)
+	if !fits(c, id, size) {
+		return ErrTooLarge
+	}
+	invalidateLoad(c, id)
+	checkMutation(c, e)
+	if opts.Notify {
+		notifyReplace(c, e, p)
+	}
+	replacePayload(c, e, p, size, opts.KeepRecency)
+	if !opts.KeepRecency && e.idleTimeout > 0 {
+		e.lastAccess = c.clock.Now()
+	}
+	invalidateDependents(c, id)
+	trimCache(c)
+	return nil
+}
+
+// replacePayload swaps the payload of an entry in place, optionally leaving it
+// where it is in the LRU list. Does not trim the cache.
+func replacePayload(c *Cache, e *cacheEntry, p Cacheable, size int64, keepRecency bool) {
+	if keepRecency && e.size != 0 && size != 0 {
+		resizeEntry(c, e, size)
+	} else {
+		unlinkEntry(c, e)
+		e.size = size
+		linkEntry(c, e)
+	}
+	e.payload = p
+	e.version++
+	rememberHash(c, e)
+	return
+}
+
+// notifyReplace tells everyone interested that this entry is being replaced
+func notifyReplace(c *Cache, e *cacheEntry, p Cacheable) {
+	if r, ok := e.payload.(NotifyReplace); ok {
+		notePanic(c, catchPanic(func() { r.OnReplace(p) }))
+	} else {
+		notePanic(c, safeOnPurge(e.payload, REPLACED))
+	}
+	for _, l := range c.listeners {
+		notePanic(c, catchPanic(func() { l(e.id, e.payload, REPLACED) }))
+	}
+	return
+}
@@ -0,0 +1,109 @@
+// Copyright © Hraban Luyat <hraban@0brg.net>
+//
+// License for use of this code is detailed in the LICENSE file
+
+package lrucache
+
+import (
+	"testing"
+)
+
+type replaceable struct {
+	purgeable
+	replacement Cacheable
+}
+
+func (x *replaceable) OnReplace(replacement Cacheable) {
+	x.replacement = replacement
+}
+
+func TestUpdate(t *testing.T) {
+	c := New(10)
+	defer c.Close()
+	var x purgeable
+	c.Set("x", &x)
+	c.Set("a", varsize(1))
+	if err := c.Update("x", varsize(3)); err != nil {
+		t.Fatal(err)
+	}
+	if x.purged {
+		t.Error("Update notified replaced value")
+	}
+	if c.Size() != 4 {
+		t.Error("Unexpected size after update:", c.Size())
+	}
+	// x is now the most recently used element
+	c.Set("b", varsize(7))
+	if _, err := c.Get("a"); err != ErrNotFound {
+		t.Error("Expected least recently used element to be purged")
+	}
+	if err := c.Update("missing", 1); err != ErrNotFound {
+		t.Error("Expected ErrNotFound, got:", err)
+	}
+	if err := c.Update("x", varsize(11)); err != ErrTooLarge {
+		t.Error("Expected ErrTooLarge, got:", err)
+	}
+	// Size 0 elements are not in the LRU list
+	if err := c.Update("x", varsize(0)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != 7 {
+		t.Error("Unexpected size after update:", c.Size())
+	}
+	checkDLL(t, c)
+	if err := c.Update("x", varsize(2)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != 9 {
+		t.Error("Unexpected size after update:", c.Size())
+	}
+
+	checkDLL(t, c)
+}
+
+func TestUpdateWithOptions(t *testing.T) {
+	var reasons []PurgeReason
+	c, err := NewWithConfig(Config{
+		MaxSize: 3,
+		Listeners: []PurgeListener{func(id string, p Cacheable, why PurgeReason) {
+			reasons = append(reasons, why)
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var x purgeable
+	var y replaceable
+	c.Set("x", &x)
+	c.Set("y", &y)
+	c.Set("z", 1)
+	opts := UpdateOptions{Notify: true, KeepRecency: true}
+	if err := c.UpdateWithOptions("x", 2, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !x.purged || x.why != REPLACED {
+		t.Error("Replaced value not purged with REPLACED")
+	}
+	if err := c.UpdateWithOptions("y", 3, opts); err != nil {
+		t.Fatal(err)
+	}
+	if y.purged || y.replacement != 3 {
+		t.Error("Replaced value not notified through OnReplace")
+	}
+	// x kept its place as least recently used
+	c.Set("w", 4)
+	if v, err := c.Get("x"); err != ErrNotFound {
+		t.Error("Expected least recently used element to be purged, got:", v)
+	}
+	expected := []PurgeReason{REPLACED, REPLACED, CACHEFULL}
+	if len(reasons) != len(expected) {
+		t.Fatal("Unexpected purges:", reasons)
+	}
+	for i := range expected {
+		if reasons[i] != expected[i] {
+			t.Fatal("Unexpected purges:", reasons)
+		}
+	}
+
+	checkDLL(t, c)
+}